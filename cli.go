@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"tinyauth-usermanagement/internal/config"
+	"tinyauth-usermanagement/internal/service"
+	"tinyauth-usermanagement/internal/store"
+)
+
+const cliUsage = `usage:
+  tinyauth-usermanagement                      run the server
+  tinyauth-usermanagement backup  [-o file] [-passphrase-file file]
+  tinyauth-usermanagement restore -i file [-passphrase-file file] [-dry-run] [-no-reload]
+
+The passphrase may also be given in BACKUP_PASSPHRASE. Use "-" for stdin
+or stdout. Restore while the server is stopped; a running server keeps its
+own copy of the user metadata.
+`
+
+// runCommand runs a CLI subcommand and returns the exit code.
+func runCommand(cfg config.Config, args []string) int {
+	var err error
+	switch args[0] {
+	case "backup":
+		err = runBackup(cfg, args[1:])
+	case "restore":
+		err = runRestore(cfg, args[1:])
+	case "help", "-h", "-help", "--help":
+		fmt.Fprint(os.Stdout, cliUsage)
+		return 0
+	default:
+		fmt.Fprint(os.Stderr, cliUsage)
+		return 2
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %v\n", args[0], err)
+		return 1
+	}
+	return 0
+}
+
+func runBackup(cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("backup", flag.ContinueOnError)
+	out := fs.String("o", "-", "archive to write")
+	passFile := fs.String("passphrase-file", "", "file holding the encryption passphrase")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	passphrase, err := cliPassphrase(*passFile)
+	if err != nil {
+		return err
+	}
+
+	st, err := store.Open(cfg.StoreBackend, cfg.UsersTOMLPath, cfg.SQLitePath)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	backup := service.NewBackupService(cfg, st, service.NewUserFileService(cfg))
+
+	var w io.Writer = os.Stdout
+	if *out != "-" {
+		f, err := os.OpenFile(*out, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		w = f
+	}
+	m, err := backup.Create(w, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "backed up %d users (%d files, encrypted: %t)\n", m.Users, len(m.Files), m.Encrypted)
+	return nil
+}
+
+func runRestore(cfg config.Config, args []string) error {
+	fs := flag.NewFlagSet("restore", flag.ContinueOnError)
+	in := fs.String("i", "", "archive to restore")
+	passFile := fs.String("passphrase-file", "", "file holding the encryption passphrase")
+	dryRun := fs.Bool("dry-run", false, "only validate the archive")
+	noReload := fs.Bool("no-reload", false, "do not reload tinyauth afterwards")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if *in == "" {
+		return fmt.Errorf("-i is required")
+	}
+	passphrase, err := cliPassphrase(*passFile)
+	if err != nil {
+		return err
+	}
+
+	var r io.Reader = os.Stdin
+	if *in != "-" {
+		f, err := os.Open(*in)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	st, err := store.Open(cfg.StoreBackend, cfg.UsersTOMLPath, cfg.SQLitePath)
+	if err != nil {
+		return err
+	}
+	defer st.Close()
+	backup := service.NewBackupService(cfg, st, service.NewUserFileService(cfg))
+
+	if *dryRun {
+		m, err := backup.Inspect(r, passphrase)
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stderr, "archive OK: %d users from %s\n", m.Users, time.Unix(m.CreatedAt, 0).UTC().Format(time.RFC3339))
+		return nil
+	}
+	m, err := backup.Restore(r, passphrase)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stderr, "restored %d users from %s\n", m.Users, time.Unix(m.CreatedAt, 0).UTC().Format(time.RFC3339))
+	if *noReload {
+		return nil
+	}
+	reloader, err := service.NewReloader(cfg)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(cfg.ReloadTimeoutSeconds)*time.Second)
+	defer cancel()
+	if err := reloader.Reload(ctx); err != nil {
+		return fmt.Errorf("reload tinyauth: %w", err)
+	}
+	return nil
+}
+
+func cliPassphrase(file string) (string, error) {
+	if file == "" {
+		return os.Getenv("BACKUP_PASSPHRASE"), nil
+	}
+	b, err := os.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(b), "\r\n"), nil
+}
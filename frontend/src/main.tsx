@@ -6,6 +6,8 @@ import { Layout } from './components/Layout'
 import LoginPage from './pages/LoginPage'
 import SignupPage from './pages/SignupPage'
 import ResetPasswordPage from './pages/ResetPasswordPage'
+import VerifyEmailPage from './pages/VerifyEmailPage'
+import ConfirmEmailPage from './pages/ConfirmEmailPage'
 import AccountPage from './pages/AccountPage'
 import './i18n'
 import './index.css'
@@ -20,8 +22,11 @@ ReactDOM.createRoot(document.getElementById('root')!).render(
           <Routes>
             <Route path='/' element={<LoginPage />} />
             {signupEnabled && <Route path='/signup' element={<SignupPage />} />}
+            {signupEnabled && <Route path='/verify-email' element={<VerifyEmailPage />} />}
             <Route path='/reset-password' element={<ResetPasswordPage />} />
             <Route path='/account' element={<AccountPage />} />
+            <Route path='/confirm-email' element={<ConfirmEmailPage />} />
+            <Route path='/cancel-email' element={<ConfirmEmailPage mode='cancel' />} />
           </Routes>
         </Layout>
       </BrowserRouter>
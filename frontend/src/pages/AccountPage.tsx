@@ -11,6 +11,12 @@ type Profile = {
   username: string
   totpEnabled: boolean
   phone?: string
+  phoneVerified?: boolean
+  pendingPhone?: string
+  email?: string
+  emailVerified?: boolean
+  pendingEmail?: string
+  recoveryCodesRemaining?: number
 }
 
 export default function AccountPage() {
@@ -20,16 +26,20 @@ export default function AccountPage() {
   const [oldPassword, setOldPassword] = useState('')
   const [newPassword, setNewPassword] = useState('')
   const [phone, setPhone] = useState('')
+  const [phoneCode, setPhoneCode] = useState('')
+  const [email, setEmail] = useState('')
   const [totpSecret, setTotpSecret] = useState('')
   const [totpCode, setTotpCode] = useState('')
   const [qrPng, setQrPng] = useState('')
   const [disablePassword, setDisablePassword] = useState('')
+  const [recoveryCodes, setRecoveryCodes] = useState<string[]>([])
 
   const load = async () => {
     try {
       const data = (await api.get('/account/profile')).data
       setProfile(data)
-      setPhone(data.phone || '')
+      setPhone(data.pendingPhone || data.phone || '')
+      setEmail(data.pendingEmail || data.email || '')
     } catch {
       setMsg(t('accountPage.notLoggedIn'))
     }
@@ -56,9 +66,59 @@ export default function AccountPage() {
             <p>
               <span className="font-medium">{t('accountPage.totpEnabled')}:</span> {String(profile.totpEnabled)}
             </p>
+            {profile.totpEnabled && (
+              <p>
+                <span className="font-medium">{t('accountPage.recoveryCodes')}:</span> {profile.recoveryCodesRemaining ?? 0}
+              </p>
+            )}
+            {profile.email && (
+              <p>
+                <span className="font-medium">{t('common.email')}:</span> {profile.email}
+                {!profile.emailVerified && ` (${t('accountPage.emailUnverified')})`}
+              </p>
+            )}
+            {profile.pendingEmail && (
+              <p>
+                <span className="font-medium">{t('accountPage.pendingEmail')}:</span> {profile.pendingEmail}{' '}
+                <button
+                  className="underline"
+                  onClick={async () => {
+                    try {
+                      await api.delete('/account/email')
+                      setMsg(t('accountPage.emailChangeCancelled'))
+                      void load()
+                    } catch (e: any) {
+                      setMsg(e?.response?.data?.error || t('accountPage.genericError'))
+                    }
+                  }}
+                >
+                  {t('common.cancel')}
+                </button>
+              </p>
+            )}
             {profile.phone && (
               <p>
                 <span className="font-medium">{t('common.phone')}:</span> {profile.phone}
+                {!profile.phoneVerified && ` (${t('accountPage.phoneUnverified')})`}
+              </p>
+            )}
+            {profile.pendingPhone && (
+              <p>
+                <span className="font-medium">{t('accountPage.pendingPhone')}:</span> {profile.pendingPhone}{' '}
+                <button
+                  className="underline"
+                  onClick={async () => {
+                    try {
+                      await api.delete('/account/phone')
+                      setMsg(t('accountPage.phoneChangeCancelled'))
+                      void load()
+                    } catch (e: any) {
+                      setMsg(e?.response?.data?.error || t('accountPage.genericError'))
+                    }
+                  }}
+                >
+                  {t('common.cancel')}
+                </button>
               </p>
             )}
           </div>
@@ -89,6 +149,31 @@ export default function AccountPage() {
           {t('accountPage.changePassword')}
         </Button>
 
+        <Separator />
+        <h3 className="text-base font-semibold">{t('common.email')}</h3>
+        <div className="flex flex-wrap gap-2">
+          <Input
+            type="email"
+            value={email}
+            onChange={(e) => setEmail(e.target.value)}
+            className="flex-1 min-w-[180px]"
+          />
+          <Button
+            variant="outline"
+            onClick={async () => {
+              try {
+                await api.post('/account/email', { email })
+                setMsg(t('accountPage.emailPending'))
+                void load()
+              } catch (e: any) {
+                setMsg(e?.response?.data?.error || t('accountPage.genericError'))
+              }
+            }}
+          >
+            {t('common.save')}
+          </Button>
+        </div>
+
         <Separator />
         <h3 className="text-base font-semibold">{t('common.phoneNumber')}</h3>
         <div className="flex flex-wrap gap-2">
@@ -102,8 +187,9 @@ export default function AccountPage() {
             variant="outline"
             onClick={async () => {
               try {
-                await api.post('/account/phone', { phone })
-                setMsg(t('accountPage.phoneUpdated'))
+                const data = (await api.post('/account/phone', { phone })).data
+                setMsg(data.pending ? t('accountPage.phoneCodeSent') : t('accountPage.phoneUpdated'))
+                setPhoneCode('')
                 void load()
               } catch (e: any) {
                 setMsg(e?.response?.data?.error || t('accountPage.genericError'))
@@ -113,6 +199,32 @@ export default function AccountPage() {
             {t('common.save')}
           </Button>
         </div>
+        {profile?.pendingPhone && (
+          <div className="flex flex-wrap gap-2">
+            <Input
+              value={phoneCode}
+              onChange={(e) => setPhoneCode(e.target.value)}
+              placeholder={t('common.code')}
+              inputMode="numeric"
+              className="flex-1 min-w-[120px]"
+            />
+            <Button
+              onClick={async () => {
+                try {
+                  await api.post('/account/phone/confirm', { code: phoneCode })
+                  setMsg(t('accountPage.phoneConfirmed'))
+                  setPhoneCode('')
+                  void load()
+                } catch (e: any) {
+                  setMsg(e?.response?.data?.error || t('accountPage.genericError'))
+                  void load()
+                }
+              }}
+            >
+              {t('accountPage.confirmPhone')}
+            </Button>
+          </div>
+        )}
 
         <Separator />
         <h3 className="text-base font-semibold">{t('accountPage.totpSetup')}</h3>
@@ -145,7 +257,8 @@ export default function AccountPage() {
           <Button
             onClick={async () => {
               try {
-                await api.post('/account/totp/enable', { secret: totpSecret, code: totpCode })
+                const data = (await api.post('/account/totp/enable', { code: totpCode })).data
+                setRecoveryCodes(data.recoveryCodes || [])
                 setMsg(t('accountPage.totpEnabledSuccess'))
                 void load()
               } catch (e: any) {
@@ -179,7 +292,32 @@ export default function AccountPage() {
           >
             {t('common.disable')}
           </Button>
+          <Button
+            variant="outline"
+            onClick={async () => {
+              try {
+                const data = (await api.post('/account/totp/recovery-codes', { password: disablePassword })).data
+                setRecoveryCodes(data.recoveryCodes || [])
+                void load()
+              } catch (e: any) {
+                setMsg(e?.response?.data?.error || t('accountPage.genericError'))
+              }
+            }}
+          >
+            {t('accountPage.regenerateRecoveryCodes')}
+          </Button>
         </div>
+
+        {recoveryCodes.length > 0 && (
+          <div className="rounded-md border bg-background/45 p-3 text-sm">
+            <p className="mb-2">{t('accountPage.recoveryCodesHelp')}</p>
+            <ul className="grid grid-cols-2 gap-1 font-mono text-xs">
+              {recoveryCodes.map((c) => (
+                <li key={c}>{c}</li>
+              ))}
+            </ul>
+          </div>
+        )}
       </CardContent>
     </Card>
   )
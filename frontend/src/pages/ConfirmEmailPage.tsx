@@ -0,0 +1,39 @@
+import { useEffect, useState } from 'react'
+import { useTranslation } from 'react-i18next'
+import { useSearchParams } from 'react-router-dom'
+import { api } from '../api/client'
+import { Card, CardContent, CardDescription, CardHeader, CardTitle } from '@/components/ui/card'
+
+// ConfirmEmailPage handles both links of an email change: confirming the
+// new address and, from the old address, cancelling the change.
+export default function ConfirmEmailPage({ mode = 'confirm' }: { mode?: 'confirm' | 'cancel' }) {
+  const { t } = useTranslation()
+  const [params] = useSearchParams()
+  const [msg, setMsg] = useState('')
+
+  useEffect(() => {
+    const token = params.get('token')
+    if (!token) {
+      setMsg(t('confirmEmailPage.missingToken'))
+      return
+    }
+    api
+      .post(mode === 'cancel' ? '/email/cancel' : '/email/confirm', { token })
+      .then(() => setMsg(mode === 'cancel' ? t('confirmEmailPage.cancelled') : t('confirmEmailPage.confirmed')))
+      .catch((e: any) => setMsg(e?.response?.data?.error || t('confirmEmailPage.error')))
+  }, [mode, params, t])
+
+  return (
+    <Card className="min-w-xs sm:min-w-sm">
+      <CardHeader>
+        <CardTitle className="text-center text-3xl">{t('confirmEmailPage.title')}</CardTitle>
+        <CardDescription className="text-center">
+          {mode === 'cancel' ? t('confirmEmailPage.cancelDescription') : t('confirmEmailPage.description')}
+        </CardDescription>
+      </CardHeader>
+      <CardContent className="flex flex-col gap-4">
+        {msg && <div className="rounded-md border bg-muted px-3 py-2 text-sm">{msg}</div>}
+      </CardContent>
+    </Card>
+  )
+}
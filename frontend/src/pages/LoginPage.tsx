@@ -13,13 +13,35 @@ export default function LoginPage() {
   const { t } = useTranslation()
   const [username, setUsername] = useState('')
   const [password, setPassword] = useState('')
+  const [ticket, setTicket] = useState('')
+  const [totpCode, setTotpCode] = useState('')
+  const [useRecovery, setUseRecovery] = useState(false)
   const [msg, setMsg] = useState('')
   const [loading, setLoading] = useState(false)
 
   const submit = async () => {
     setLoading(true)
     try {
-      await api.post('/auth/login', { username, password })
+      const data = (await api.post('/auth/login', { username, password })).data
+      if (data.totpRequired) {
+        setTicket(data.ticket)
+        setMsg(t('loginPage.totpRequired'))
+        return
+      }
+      setMsg(t('loginPage.success'))
+    } catch (e: any) {
+      setMsg(e?.response?.data?.error || t('loginPage.error'))
+    } finally {
+      setLoading(false)
+    }
+  }
+
+  const submitTotp = async () => {
+    setLoading(true)
+    try {
+      await api.post('/auth/login/totp', useRecovery ? { ticket, recoveryCode: totpCode } : { ticket, code: totpCode })
+      setTicket('')
+      setTotpCode('')
       setMsg(t('loginPage.success'))
     } catch (e: any) {
       setMsg(e?.response?.data?.error || t('loginPage.error'))
@@ -36,17 +58,46 @@ export default function LoginPage() {
       </CardHeader>
       <CardContent className="flex flex-col gap-4">
         {msg && <div className="rounded-md border bg-muted px-3 py-2 text-sm">{msg}</div>}
-        <div className="grid gap-2">
-          <Label htmlFor="username">{t('common.username')}</Label>
-          <Input id="username" value={username} onChange={(e) => setUsername(e.target.value)} />
-        </div>
-        <div className="grid gap-2">
-          <Label htmlFor="password">{t('common.password')}</Label>
-          <Input id="password" type="password" value={password} onChange={(e) => setPassword(e.target.value)} />
-        </div>
-        <Button onClick={submit} loading={loading} disabled={!username || !password}>
-          {t('loginPage.submit')}
-        </Button>
+        {ticket ? (
+          <>
+            <div className="grid gap-2">
+              <Label htmlFor="totpCode">{useRecovery ? t('loginPage.recoveryCode') : t('common.code')}</Label>
+              <Input
+                id="totpCode"
+                inputMode={useRecovery ? 'text' : 'numeric'}
+                autoComplete="one-time-code"
+                value={totpCode}
+                onChange={(e) => setTotpCode(e.target.value)}
+              />
+            </div>
+            <Button onClick={submitTotp} loading={loading} disabled={!totpCode}>
+              {t('loginPage.verify')}
+            </Button>
+            <Button
+              variant="link"
+              onClick={() => {
+                setUseRecovery(!useRecovery)
+                setTotpCode('')
+              }}
+            >
+              {useRecovery ? t('loginPage.useAuthenticator') : t('loginPage.useRecoveryCode')}
+            </Button>
+          </>
+        ) : (
+          <>
+            <div className="grid gap-2">
+              <Label htmlFor="username">{t('common.username')}</Label>
+              <Input id="username" value={username} onChange={(e) => setUsername(e.target.value)} />
+            </div>
+            <div className="grid gap-2">
+              <Label htmlFor="password">{t('common.password')}</Label>
+              <Input id="password" type="password" value={password} onChange={(e) => setPassword(e.target.value)} />
+            </div>
+            <Button onClick={submit} loading={loading} disabled={!username || !password}>
+              {t('loginPage.submit')}
+            </Button>
+          </>
+        )}
       </CardContent>
       <CardFooter className={signupEnabled ? "flex justify-between text-sm" : "flex justify-end text-sm"}>
         {signupEnabled && (
@@ -19,7 +19,11 @@ export default function SignupPage() {
     setLoading(true)
     try {
       const res = await api.post('/signup', { username, email, password, phone: phone || undefined })
-      setMsg(t('signupPage.status', { status: res.data.status }))
+      setMsg(
+        res.data.status === 'verify_email'
+          ? t('signupPage.verifyEmail')
+          : t('signupPage.status', { status: res.data.status })
+      )
     } catch (e: any) {
       setMsg(e?.response?.data?.error || t('signupPage.error'))
     } finally {
@@ -0,0 +1,37 @@
+import { useEffect, useState } from 'react'
+import { useTranslation } from 'react-i18next'
+import { useSearchParams } from 'react-router-dom'
+import { api } from '../api/client'
+import { Card, CardContent, CardDescription, CardHeader, CardTitle } from '@/components/ui/card'
+
+export default function VerifyEmailPage() {
+  const { t } = useTranslation()
+  const [params] = useSearchParams()
+  const [msg, setMsg] = useState('')
+
+  useEffect(() => {
+    const token = params.get('token')
+    if (!token) {
+      setMsg(t('verifyEmailPage.missingToken'))
+      return
+    }
+    api
+      .post('/signup/verify', { token })
+      .then((res) =>
+        setMsg(res.data.status === 'pending_approval' ? t('verifyEmailPage.pendingApproval') : t('verifyEmailPage.approved'))
+      )
+      .catch((e: any) => setMsg(e?.response?.data?.error || t('verifyEmailPage.error')))
+  }, [params, t])
+
+  return (
+    <Card className="min-w-xs sm:min-w-sm">
+      <CardHeader>
+        <CardTitle className="text-center text-3xl">{t('verifyEmailPage.title')}</CardTitle>
+        <CardDescription className="text-center">{t('verifyEmailPage.description')}</CardDescription>
+      </CardHeader>
+      <CardContent className="flex flex-col gap-4">
+        {msg && <div className="rounded-md border bg-muted px-3 py-2 text-sm">{msg}</div>}
+      </CardContent>
+    </Card>
+  )
+}
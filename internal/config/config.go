@@ -6,47 +6,141 @@ import (
 	"strings"
 )
 
+// DefaultSessionSecret is the SESSION_SECRET used when none is set. Since
+// it is public, the server refuses to start with it.
+const DefaultSessionSecret = "dev-secret-change-me"
+
 type Config struct {
-	Port                    string
-	UsersFilePath           string
-	SessionCookieName       string
-	SessionSecret           string
-	SessionTTLSeconds       int64
-	ResetTokenTTLSeconds    int64
-	SignupRequireApproval   bool
-	SMTPHost                string
-	SMTPPort                int
-	SMTPUsername            string
-	SMTPPassword            string
-	SMTPFrom                string
-	MailBaseURL             string
-	TOTPIssuer              string
-	TinyauthContainerName   string
-	DockerSocketPath        string
-	SecureCookie            bool
-	CORSOrigins             []string
+	Port                       string
+	UsersFilePath              string
+	UsersFileStrict            bool
+	UsersFileWatch             bool
+	UsersHistoryDir            string
+	UsersHistoryRetention      int
+	StoreBackend               string
+	UsersTOMLPath              string
+	SQLitePath                 string
+	StoreJanitorSeconds        int64
+	SessionCookieName          string
+	SessionSecret              string
+	SessionTTLSeconds          int64
+	ResetTokenTTLSeconds       int64
+	MFATicketTTLSeconds        int64
+	SignupRequireApproval      bool
+	SignupTTLSeconds           int64
+	SignupVerifyEmail          bool
+	SignupVerifyTTLSeconds     int64
+	EmailVerifyTTLSeconds      int64
+	UsernameMinLength          int
+	UsernameMaxLength          int
+	UsernameCaseFold           bool
+	UsernameReserved           []string
+	SMTPHost                   string
+	SMTPPort                   int
+	SMTPUsername               string
+	SMTPPassword               string
+	SMTPFrom                   string
+	MailBaseURL                string
+	TOTPIssuer                 string
+	TOTPRecoveryCodeCount      int
+	TOTPEnrollTTLSeconds       int64
+	TinyauthContainerName      string
+	DockerSocketPath           string
+	TinyauthServiceName        string
+	ReloadStrategy             string
+	ReloadSignal               string
+	ReloadCommand              string
+	ReloadHTTPURL              string
+	ReloadHTTPMethod           string
+	ReloadHTTPHeaders          string
+	ReloadTimeoutSeconds       int
+	ReloadHealthCheck          bool
+	TinyauthHealthURL          string
+	ReloadHealthTimeoutSeconds int
+	ReloadHealthIntervalMillis int
+	ReloadHealthStableSeconds  int
+	ReloadRollback             bool
+	ReloadDebounceMillis       int
+	ReloadMaxRetries           int
+	ReloadRetryDelaySeconds    int
+	SecureCookie               bool
+	RateLimitEnabled           bool
+	RateLimitMaxAttempts       int
+	RateLimitIPMaxAttempts     int
+	RateLimitWindowSeconds     int64
+	RateLimitLockoutSeconds    int64
+	RateLimitMaxLockoutSeconds int64
+	TrustedProxies             []string
+	SMSCodeMaxAttempts         int
+	PhoneDefaultRegion         string
+	CORSOrigins                []string
 }
 
 func Load() Config {
 	return Config{
-		Port:                  getEnv("PORT", "8080"),
-		UsersFilePath:         getEnv("USERS_FILE_PATH", "/data/users.txt"),
-		SessionCookieName:     getEnv("SESSION_COOKIE_NAME", "tinyauth_um_session"),
-		SessionSecret:         getEnv("SESSION_SECRET", "dev-secret-change-me"),
-		SessionTTLSeconds:     getEnvInt64("SESSION_TTL_SECONDS", 86400),
-		ResetTokenTTLSeconds:  getEnvInt64("RESET_TOKEN_TTL_SECONDS", 3600),
-		SignupRequireApproval: getEnvBool("SIGNUP_REQUIRE_APPROVAL", false),
-		SMTPHost:              getEnv("SMTP_HOST", ""),
-		SMTPPort:              getEnvInt("SMTP_PORT", 587),
-		SMTPUsername:          getEnv("SMTP_USERNAME", ""),
-		SMTPPassword:          getEnv("SMTP_PASSWORD", ""),
-		SMTPFrom:              getEnv("SMTP_FROM", "noreply@example.local"),
-		MailBaseURL:           getEnv("MAIL_BASE_URL", "http://localhost:8080"),
-		TOTPIssuer:            getEnv("TOTP_ISSUER", "tinyauth"),
-		TinyauthContainerName: getEnv("TINYAUTH_CONTAINER_NAME", "tinyauth"),
-		DockerSocketPath:      getEnv("DOCKER_SOCKET_PATH", "/var/run/docker.sock"),
-		SecureCookie:          getEnvBool("SECURE_COOKIE", false),
-		CORSOrigins:           parseCSV(getEnv("CORS_ORIGINS", "http://localhost:5173,http://localhost:8080")),
+		Port:                       getEnv("PORT", "8080"),
+		UsersFilePath:              getEnv("USERS_FILE_PATH", "/data/users.txt"),
+		UsersFileStrict:            getEnvBool("USERS_FILE_STRICT", false),
+		UsersFileWatch:             getEnvBool("USERS_FILE_WATCH", true),
+		UsersHistoryDir:            getEnv("USERS_HISTORY_DIR", ""),
+		UsersHistoryRetention:      getEnvInt("USERS_HISTORY_RETENTION", 50),
+		StoreBackend:               getEnv("STORE_BACKEND", "toml"),
+		UsersTOMLPath:              getEnv("USERS_TOML", "/users/users.toml"),
+		SQLitePath:                 getEnv("SQLITE_PATH", ""),
+		StoreJanitorSeconds:        getEnvInt64("STORE_JANITOR_INTERVAL_SECONDS", 300),
+		SessionCookieName:          getEnv("SESSION_COOKIE_NAME", "tinyauth_um_session"),
+		SessionSecret:              getEnv("SESSION_SECRET", DefaultSessionSecret),
+		SessionTTLSeconds:          getEnvInt64("SESSION_TTL_SECONDS", 86400),
+		ResetTokenTTLSeconds:       getEnvInt64("RESET_TOKEN_TTL_SECONDS", 3600),
+		MFATicketTTLSeconds:        getEnvInt64("MFA_TICKET_TTL_SECONDS", 300),
+		SignupRequireApproval:      getEnvBool("SIGNUP_REQUIRE_APPROVAL", false),
+		SignupTTLSeconds:           getEnvInt64("SIGNUP_TTL_SECONDS", 7*86400),
+		SignupVerifyEmail:          getEnvBool("SIGNUP_VERIFY_EMAIL", false),
+		SignupVerifyTTLSeconds:     getEnvInt64("SIGNUP_VERIFY_TTL_SECONDS", 86400),
+		EmailVerifyTTLSeconds:      getEnvInt64("EMAIL_VERIFY_TTL_SECONDS", 86400),
+		UsernameMinLength:          getEnvInt("USERNAME_MIN_LENGTH", 3),
+		UsernameMaxLength:          getEnvInt("USERNAME_MAX_LENGTH", 32),
+		UsernameCaseFold:           getEnvBool("USERNAME_CASE_FOLD", true),
+		UsernameReserved:           parseCSV(getEnv("USERNAME_RESERVED", "admin,administrator,root,system,tinyauth")),
+		SMTPHost:                   getEnv("SMTP_HOST", ""),
+		SMTPPort:                   getEnvInt("SMTP_PORT", 587),
+		SMTPUsername:               getEnv("SMTP_USERNAME", ""),
+		SMTPPassword:               getEnv("SMTP_PASSWORD", ""),
+		SMTPFrom:                   getEnv("SMTP_FROM", "noreply@example.local"),
+		MailBaseURL:                getEnv("MAIL_BASE_URL", "http://localhost:8080"),
+		TOTPIssuer:                 getEnv("TOTP_ISSUER", "tinyauth"),
+		TOTPRecoveryCodeCount:      getEnvInt("TOTP_RECOVERY_CODE_COUNT", 10),
+		TOTPEnrollTTLSeconds:       getEnvInt64("TOTP_ENROLL_TTL_SECONDS", 600),
+		TinyauthContainerName:      getEnv("TINYAUTH_CONTAINER_NAME", "tinyauth"),
+		DockerSocketPath:           getEnv("DOCKER_SOCKET_PATH", "/var/run/docker.sock"),
+		TinyauthServiceName:        getEnv("TINYAUTH_SERVICE_NAME", ""),
+		ReloadStrategy:             getEnv("RELOAD_STRATEGY", "docker-restart"),
+		ReloadSignal:               getEnv("RELOAD_SIGNAL", "SIGHUP"),
+		ReloadCommand:              getEnv("RELOAD_COMMAND", ""),
+		ReloadHTTPURL:              getEnv("RELOAD_HTTP_URL", ""),
+		ReloadHTTPMethod:           getEnv("RELOAD_HTTP_METHOD", "POST"),
+		ReloadHTTPHeaders:          getEnv("RELOAD_HTTP_HEADERS", ""),
+		ReloadTimeoutSeconds:       getEnvInt("RELOAD_TIMEOUT_SECONDS", 30),
+		ReloadHealthCheck:          getEnvBool("RELOAD_HEALTH_CHECK", true),
+		TinyauthHealthURL:          getEnv("TINYAUTH_HEALTH_URL", ""),
+		ReloadHealthTimeoutSeconds: getEnvInt("RELOAD_HEALTH_TIMEOUT_SECONDS", 60),
+		ReloadHealthIntervalMillis: getEnvInt("RELOAD_HEALTH_INTERVAL_MS", 1000),
+		ReloadHealthStableSeconds:  getEnvInt("RELOAD_HEALTH_STABLE_SECONDS", 10),
+		ReloadRollback:             getEnvBool("RELOAD_ROLLBACK", false),
+		ReloadDebounceMillis:       getEnvInt("RELOAD_DEBOUNCE_MS", 2000),
+		ReloadMaxRetries:           getEnvInt("RELOAD_MAX_RETRIES", 3),
+		ReloadRetryDelaySeconds:    getEnvInt("RELOAD_RETRY_DELAY_SECONDS", 5),
+		SecureCookie:               getEnvBool("SECURE_COOKIE", false),
+		RateLimitEnabled:           getEnvBool("RATE_LIMIT_ENABLED", true),
+		RateLimitMaxAttempts:       getEnvInt("RATE_LIMIT_MAX_ATTEMPTS", 5),
+		RateLimitIPMaxAttempts:     getEnvInt("RATE_LIMIT_IP_MAX_ATTEMPTS", 20),
+		RateLimitWindowSeconds:     getEnvInt64("RATE_LIMIT_WINDOW_SECONDS", 900),
+		RateLimitLockoutSeconds:    getEnvInt64("RATE_LIMIT_LOCKOUT_SECONDS", 60),
+		RateLimitMaxLockoutSeconds: getEnvInt64("RATE_LIMIT_MAX_LOCKOUT_SECONDS", 3600),
+		TrustedProxies:             getEnvList("TRUSTED_PROXIES"),
+		SMSCodeMaxAttempts:         getEnvInt("SMS_CODE_MAX_ATTEMPTS", 3),
+		PhoneDefaultRegion:         getEnv("PHONE_DEFAULT_REGION", ""),
+		CORSOrigins:                parseCSV(getEnv("CORS_ORIGINS", "http://localhost:5173,http://localhost:8080")),
 	}
 }
 
@@ -82,6 +176,14 @@ func getEnvBool(key string, fallback bool) bool {
 	return fallback
 }
 
+// getEnvList reads a comma separated list, nil if the variable is unset.
+func getEnvList(key string) []string {
+	if strings.TrimSpace(os.Getenv(key)) == "" {
+		return nil
+	}
+	return parseCSV(os.Getenv(key))
+}
+
 func parseCSV(v string) []string {
 	parts := strings.Split(v, ",")
 	res := make([]string, 0, len(parts))
@@ -9,18 +9,28 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-type AccountHandler struct{ account *service.AccountService }
+type AccountHandler struct {
+	account *service.AccountService
+	limiter *service.RateLimitService
+}
 
-func NewAccountHandler(account *service.AccountService) *AccountHandler { return &AccountHandler{account: account} }
+func NewAccountHandler(account *service.AccountService, limiter *service.RateLimitService) *AccountHandler {
+	return &AccountHandler{account: account, limiter: limiter}
+}
 
 func (h *AccountHandler) Register(r *gin.RouterGroup) {
 	r.GET("/account/profile", h.Profile)
 	r.POST("/account/change-password", h.ChangePassword)
 	r.POST("/account/phone", h.UpdatePhone)
+	r.POST("/account/phone/confirm", h.ConfirmPhone)
+	r.DELETE("/account/phone", h.CancelPhoneChange)
+	r.POST("/account/email", h.UpdateEmail)
+	r.DELETE("/account/email", h.CancelEmailChange)
 	r.POST("/account/totp/setup", h.TotpSetup)
 	r.POST("/account/totp/enable", h.TotpEnable)
 	r.POST("/account/totp/disable", h.TotpDisable)
 	r.POST("/account/totp/recover", h.TotpRecover)
+	r.POST("/account/totp/recovery-codes", h.RegenerateRecoveryCodes)
 }
 
 func username(c *gin.Context) string {
@@ -29,6 +39,10 @@ func username(c *gin.Context) string {
 	return v
 }
 
+func sessionToken(c *gin.Context) string {
+	return c.GetString("sessionToken")
+}
+
 func (h *AccountHandler) Profile(c *gin.Context) {
 	p, err := h.account.Profile(username(c))
 	if err != nil {
@@ -62,7 +76,87 @@ func (h *AccountHandler) UpdatePhone(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.account.SetPhone(username(c), req.Phone); err != nil {
+	// Codes are texted to numbers the user types in, so they count
+	// against the same limits as SMS password resets.
+	if phone, err := h.account.NormalizePhone(req.Phone); err == nil {
+		req.Phone = phone
+	}
+	keys := []string{
+		service.LimitKey(service.LimitScopeSMSRequest, service.LimitKindUser, username(c)),
+		service.LimitKey(service.LimitScopeSMSRequest, service.LimitKindPhone, req.Phone),
+	}
+	allowed, wait := h.limiter.Allow(keys...)
+	if !allowed && req.Phone != "" {
+		tooManyRequests(c, wait)
+		return
+	}
+	pending, err := h.account.RequestPhoneChange(username(c), req.Phone)
+	if allowed && (err != nil || !pending) {
+		h.limiter.Undo(keys...)
+	}
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "pending": pending})
+}
+
+// ConfirmPhone takes the code texted by UpdatePhone and makes the pending
+// number the phone number of the user.
+func (h *AccountHandler) ConfirmPhone(c *gin.Context) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.account.ConfirmPhone(username(c), req.Code); err != nil {
+		badRequest(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// CancelPhoneChange drops a pending phone number.
+func (h *AccountHandler) CancelPhoneChange(c *gin.Context) {
+	if err := h.account.CancelPendingPhone(username(c)); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// UpdateEmail starts a change of the email address; it only takes effect
+// once the link sent to the new address is followed.
+func (h *AccountHandler) UpdateEmail(c *gin.Context) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	// Each request mails the new and the old address.
+	keys := []string{
+		service.LimitKey(service.LimitScopeEmailChange, service.LimitKindUser, username(c)),
+		service.LimitKey(service.LimitScopeEmailChange, service.LimitKindEmail, req.Email),
+	}
+	if ok, wait := h.limiter.Allow(keys...); !ok {
+		tooManyRequests(c, wait)
+		return
+	}
+	if err := h.account.RequestEmailChange(username(c), req.Email); err != nil {
+		h.limiter.Undo(keys...)
+		badRequest(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "pending": true})
+}
+
+// CancelEmailChange drops a pending email change.
+func (h *AccountHandler) CancelEmailChange(c *gin.Context) {
+	if err := h.account.CancelPendingEmail(username(c)); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -70,7 +164,7 @@ func (h *AccountHandler) UpdatePhone(c *gin.Context) {
 }
 
 func (h *AccountHandler) TotpSetup(c *gin.Context) {
-	secret, otpURL, pngBytes, err := h.account.TotpSetup(username(c))
+	secret, otpURL, pngBytes, err := h.account.TotpSetup(username(c), sessionToken(c))
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
@@ -84,18 +178,18 @@ func (h *AccountHandler) TotpSetup(c *gin.Context) {
 
 func (h *AccountHandler) TotpEnable(c *gin.Context) {
 	var req struct {
-		Secret string `json:"secret"`
-		Code   string `json:"code"`
+		Code string `json:"code"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.account.TotpEnable(username(c), req.Secret, req.Code); err != nil {
+	codes, err := h.account.TotpEnable(username(c), sessionToken(c), req.Code)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	c.JSON(http.StatusOK, gin.H{"ok": true, "recoveryCodes": codes})
 }
 
 func (h *AccountHandler) TotpDisable(c *gin.Context) {
@@ -113,17 +207,33 @@ func (h *AccountHandler) TotpDisable(c *gin.Context) {
 
 func (h *AccountHandler) TotpRecover(c *gin.Context) {
 	var req struct {
-		RecoveryKey string `json:"recoveryKey"`
-		Secret      string `json:"secret"`
-		Code        string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+		Code         string `json:"code"`
 	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.account.TotpRecover(username(c), req.RecoveryKey, req.Secret, req.Code); err != nil {
+	codes, err := h.account.TotpRecover(username(c), sessionToken(c), req.RecoveryCode, req.Code)
+	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	c.JSON(http.StatusOK, gin.H{"ok": true})
+	c.JSON(http.StatusOK, gin.H{"ok": true, "recoveryCodes": codes})
+}
+
+func (h *AccountHandler) RegenerateRecoveryCodes(c *gin.Context) {
+	var req struct {
+		Password string `json:"password"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	codes, err := h.account.RegenerateRecoveryCodes(username(c), req.Password)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "recoveryCodes": codes})
 }
@@ -0,0 +1,366 @@
+package handler
+
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"time"
+
+	"tinyauth-usermanagement/internal/provider"
+	"tinyauth-usermanagement/internal/service"
+	"tinyauth-usermanagement/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+type AdminHandler struct {
+	admin   *service.AdminService
+	history *service.HistoryService
+	backup  *service.BackupService
+	limiter *service.RateLimitService
+}
+
+func NewAdminHandler(admin *service.AdminService, history *service.HistoryService, backup *service.BackupService, limiter *service.RateLimitService) *AdminHandler {
+	return &AdminHandler{admin: admin, history: history, backup: backup, limiter: limiter}
+}
+
+// Register mounts the admin routes. The group must already be guarded by
+// SessionMiddleware and AdminMiddleware.
+func (h *AdminHandler) Register(r *gin.RouterGroup) {
+	r.GET("/users", h.ListUsers)
+	r.POST("/users", h.CreateUser)
+	r.POST("/users/import", h.ImportUsers)
+	r.GET("/users/:username", h.GetUser)
+	r.PUT("/users/:username", h.UpdateUser)
+	r.DELETE("/users/:username", h.DeleteUser)
+	r.POST("/users/:username/totp/reset", h.ResetTotp)
+	r.POST("/users/:username/password/reset", h.ForcePasswordReset)
+	r.GET("/signups", h.ListSignups)
+	r.POST("/signups/:id/approve", h.ApproveSignup)
+	r.POST("/signups/:id/reject", h.RejectSignup)
+	r.GET("/users-file/doctor", h.DiagnoseUsersFile)
+	r.POST("/users-file/repair", h.RepairUsersFile)
+	r.GET("/history", h.ListHistory)
+	r.GET("/history/diff", h.DiffHistory)
+	r.POST("/history/:id/rollback", h.RollbackHistory)
+	r.POST("/backup", h.CreateBackup)
+	r.POST("/restore", h.RestoreBackup)
+	r.GET("/reload", h.ReloadStatus)
+	r.POST("/reload", h.RequestReload)
+	r.GET("/sms", h.SMSStatus)
+	r.GET("/lockouts", h.ListLockouts)
+	r.POST("/lockouts/clear", h.ClearLockout)
+}
+
+// ListUsers takes the optional filters ?q= (username, name or phone),
+// ?role= and ?totp=true|false.
+func (h *AdminHandler) ListUsers(c *gin.Context) {
+	filter := service.UserFilter{Query: c.Query("q"), Role: c.Query("role")}
+	if v := c.Query("totp"); v != "" {
+		totp, err := strconv.ParseBool(v)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "totp must be true or false"})
+			return
+		}
+		filter.Totp = &totp
+	}
+	users, err := h.admin.ListUsers(filter)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"users": users})
+}
+
+func (h *AdminHandler) GetUser(c *gin.Context) {
+	u, err := h.admin.GetUser(c.Param("username"))
+	if err != nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, u)
+}
+
+func (h *AdminHandler) CreateUser(c *gin.Context) {
+	var req service.AdminUserCreate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u, password, err := h.admin.CreateUser(req)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+	// The generated password is only ever shown in this response.
+	c.JSON(http.StatusOK, struct {
+		service.AdminUser
+		Password string `json:"password,omitempty"`
+	}{u, password})
+}
+
+func (h *AdminHandler) UpdateUser(c *gin.Context) {
+	var req service.AdminUserUpdate
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	u, err := h.admin.UpdateUser(username(c), c.Param("username"), req)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, u)
+}
+
+func (h *AdminHandler) DeleteUser(c *gin.Context) {
+	if err := h.admin.DeleteUser(username(c), c.Param("username")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (h *AdminHandler) ResetTotp(c *gin.Context) {
+	if err := h.admin.ResetTotp(c.Param("username")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (h *AdminHandler) ForcePasswordReset(c *gin.Context) {
+	if err := h.admin.ForcePasswordReset(username(c), c.Param("username")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// ListSignups returns the pending signups with their age in seconds.
+func (h *AdminHandler) ListSignups(c *gin.Context) {
+	signups, err := h.admin.PendingSignups()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	type signup struct {
+		store.PendingSignup
+		AgeSeconds int64 `json:"ageSeconds"`
+	}
+	now := time.Now().Unix()
+	res := make([]signup, 0, len(signups))
+	for _, ps := range signups {
+		res = append(res, signup{ps, now - ps.CreatedAt})
+	}
+	c.JSON(http.StatusOK, gin.H{"signups": res})
+}
+
+func (h *AdminHandler) ApproveSignup(c *gin.Context) {
+	reason, ok := signupReason(c)
+	if !ok {
+		return
+	}
+	if err := h.admin.ApproveSignup(c.Param("id"), reason); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (h *AdminHandler) RejectSignup(c *gin.Context) {
+	reason, ok := signupReason(c)
+	if !ok {
+		return
+	}
+	if err := h.admin.RejectSignup(c.Param("id"), reason); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// signupReason reads the optional {"reason": "..."} body of a signup
+// decision. It responds itself and returns false if the body is invalid.
+func signupReason(c *gin.Context) (string, bool) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return "", false
+		}
+	}
+	return req.Reason, true
+}
+
+func (h *AdminHandler) ImportUsers(c *gin.Context) {
+	var req struct {
+		Users     []service.ImportUser `json:"users"`
+		Overwrite bool                 `json:"overwrite"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	results, err := h.admin.ImportUsers(req.Users, req.Overwrite)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"results": results})
+}
+
+func (h *AdminHandler) DiagnoseUsersFile(c *gin.Context) {
+	d, err := h.admin.DiagnoseUsersFile()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+func (h *AdminHandler) RepairUsersFile(c *gin.Context) {
+	var req struct {
+		Checksum string `json:"checksum"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if req.Checksum == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "checksum from the diagnosis required"})
+		return
+	}
+	d, err := h.admin.RepairUsersFile(req.Checksum)
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, d)
+}
+
+func (h *AdminHandler) ListHistory(c *gin.Context) {
+	versions, err := h.history.List()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": h.history.Enabled(), "versions": versions})
+}
+
+// DiffHistory compares ?from= with ?to= (default "current").
+func (h *AdminHandler) DiffHistory(c *gin.Context) {
+	to := c.DefaultQuery("to", service.HistoryCurrent)
+	diff, err := h.history.Diff(c.Query("from"), to)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"from": c.Query("from"), "to": to, "users": diff})
+}
+
+func (h *AdminHandler) RollbackHistory(c *gin.Context) {
+	if err := h.history.Rollback(c.Param("id")); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// CreateBackup streams a backup archive, encrypted when a passphrase is
+// given.
+func (h *AdminHandler) CreateBackup(c *gin.Context) {
+	var req struct {
+		Passphrase string `json:"passphrase"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&req); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if _, err := h.backup.Create(&buf, req.Passphrase); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	name := "tinyauth-usermanagement-" + time.Now().UTC().Format("20060102-150405") + ".tar.gz"
+	if req.Passphrase != "" {
+		name += ".enc"
+	}
+	c.Header("Content-Disposition", `attachment; filename="`+name+`"`)
+	c.Data(http.StatusOK, "application/octet-stream", buf.Bytes())
+}
+
+// RestoreBackup takes a multipart form with the "archive" file and an
+// optional "passphrase". With dryRun=true the archive is only validated.
+func (h *AdminHandler) RestoreBackup(c *gin.Context) {
+	fh, err := c.FormFile("archive")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "archive file required"})
+		return
+	}
+	f, err := fh.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	defer f.Close()
+
+	passphrase := c.PostForm("passphrase")
+	if c.PostForm("dryRun") == "true" {
+		m, err := h.backup.Inspect(f, passphrase)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{"ok": true, "dryRun": true, "manifest": m})
+		return
+	}
+	m, err := h.backup.Restore(f, passphrase)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	h.admin.RequestReload()
+	c.JSON(http.StatusOK, gin.H{"ok": true, "manifest": m})
+}
+
+func (h *AdminHandler) ReloadStatus(c *gin.Context) {
+	c.JSON(http.StatusOK, h.admin.ReloadStatus())
+}
+
+func (h *AdminHandler) RequestReload(c *gin.Context) {
+	h.admin.RequestReload()
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// SMSStatus lists the SMS providers with their circuit breaker state.
+func (h *AdminHandler) SMSStatus(c *gin.Context) {
+	enabled, providers := h.admin.SMSStatus()
+	if providers == nil {
+		providers = []provider.SMSProviderStatus{}
+	}
+	c.JSON(http.StatusOK, gin.H{"enabled": enabled, "providers": providers})
+}
+
+func (h *AdminHandler) ListLockouts(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"lockouts": h.limiter.Lockouts()})
+}
+
+func (h *AdminHandler) ClearLockout(c *gin.Context) {
+	var req struct {
+		Key string `json:"key"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !h.limiter.Clear(req.Key) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "not found"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
@@ -10,16 +10,18 @@ import (
 )
 
 type AuthHandler struct {
-	auth *service.AuthService
-	cfg  config.Config
+	auth    *service.AuthService
+	limiter *service.RateLimitService
+	cfg     config.Config
 }
 
-func NewAuthHandler(cfg config.Config, auth *service.AuthService) *AuthHandler {
-	return &AuthHandler{auth: auth, cfg: cfg}
+func NewAuthHandler(cfg config.Config, auth *service.AuthService, limiter *service.RateLimitService) *AuthHandler {
+	return &AuthHandler{auth: auth, limiter: limiter, cfg: cfg}
 }
 
 func (h *AuthHandler) Register(r *gin.RouterGroup) {
 	r.POST("/auth/login", h.Login)
+	r.POST("/auth/login/totp", h.LoginTotp)
 	r.POST("/auth/logout", h.Logout)
 }
 
@@ -32,11 +34,58 @@ func (h *AuthHandler) Login(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	token, err := h.auth.Login(req.Username, req.Password)
+	keys := []string{
+		service.LimitKey(service.LimitScopeLogin, service.LimitKindIP, c.ClientIP()),
+		service.LimitKey(service.LimitScopeLogin, service.LimitKindUser, req.Username),
+	}
+	if ok, wait := h.limiter.Allow(keys...); !ok {
+		tooManyRequests(c, wait)
+		return
+	}
+	res, err := h.auth.Login(req.Username, req.Password)
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 		return
 	}
+	h.limiter.Undo(keys[0])
+	h.limiter.Success(keys[1])
+	if res.MFATicket != "" {
+		c.JSON(http.StatusOK, gin.H{"ok": true, "totpRequired": true, "ticket": res.MFATicket})
+		return
+	}
+	c.SetCookie(h.cfg.SessionCookieName, res.SessionToken, int(h.cfg.SessionTTLSeconds), "/", "", h.cfg.SecureCookie, true)
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+func (h *AuthHandler) LoginTotp(c *gin.Context) {
+	var req struct {
+		Ticket       string `json:"ticket"`
+		Code         string `json:"code"`
+		RecoveryCode string `json:"recoveryCode"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	ipKey := service.LimitKey(service.LimitScopeLogin, service.LimitKindIP, c.ClientIP())
+	if ok, wait := h.limiter.Allow(ipKey); !ok {
+		tooManyRequests(c, wait)
+		return
+	}
+	var (
+		token string
+		err   error
+	)
+	if req.RecoveryCode != "" {
+		token, err = h.auth.LoginRecovery(req.Ticket, req.RecoveryCode)
+	} else {
+		token, err = h.auth.LoginTotp(req.Ticket, req.Code)
+	}
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+		return
+	}
+	h.limiter.Undo(ipKey)
 	c.SetCookie(h.cfg.SessionCookieName, token, int(h.cfg.SessionTTLSeconds), "/", "", h.cfg.SecureCookie, true)
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
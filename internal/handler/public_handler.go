@@ -9,15 +9,22 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-type PublicHandler struct{ account *service.AccountService }
+type PublicHandler struct {
+	account *service.AccountService
+	limiter *service.RateLimitService
+}
 
-func NewPublicHandler(account *service.AccountService) *PublicHandler { return &PublicHandler{account: account} }
+func NewPublicHandler(account *service.AccountService, limiter *service.RateLimitService) *PublicHandler {
+	return &PublicHandler{account: account, limiter: limiter}
+}
 
 func (h *PublicHandler) Register(r *gin.RouterGroup) {
 	r.POST("/password-reset/request", h.RequestReset)
 	r.POST("/password-reset/confirm", h.ConfirmReset)
 	r.POST("/signup", h.Signup)
-	r.POST("/signup/approve", h.ApproveSignup)
+	r.POST("/signup/verify", h.VerifySignup)
+	r.POST("/email/confirm", h.ConfirmEmail)
+	r.POST("/email/cancel", h.CancelEmailChange)
 	r.GET("/health", func(c *gin.Context) { c.JSON(200, gin.H{"ok": true}) })
 	r.GET("/features", h.Features)
 	r.POST("/auth/forgot-password-sms", h.ForgotPasswordSMS)
@@ -31,6 +38,15 @@ func (h *PublicHandler) RequestReset(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// Every request counts, so the endpoint cannot be used to spam mailboxes.
+	keys := []string{
+		service.LimitKey(service.LimitScopeResetRequest, service.LimitKindIP, c.ClientIP()),
+		service.LimitKey(service.LimitScopeResetRequest, service.LimitKindUser, req.Username),
+	}
+	if ok, wait := h.limiter.Allow(keys...); !ok {
+		tooManyRequests(c, wait)
+		return
+	}
 	_ = h.account.RequestPasswordReset(req.Username)
 	c.JSON(http.StatusOK, gin.H{"ok": true, "message": "If user exists, reset email sent"})
 }
@@ -62,7 +78,32 @@ func (h *PublicHandler) Signup(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	// Every request counts: a signup may mail a verification link.
+	keys := []string{service.LimitKey(service.LimitScopeSignup, service.LimitKindIP, c.ClientIP())}
+	if req.Email != "" {
+		keys = append(keys, service.LimitKey(service.LimitScopeSignup, service.LimitKindEmail, req.Email))
+	}
+	if ok, wait := h.limiter.Allow(keys...); !ok {
+		tooManyRequests(c, wait)
+		return
+	}
 	status, err := h.account.SignupWithPhone(req.Username, req.Email, req.Password, req.Phone)
+	if err != nil {
+		badRequest(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true, "status": status})
+}
+
+func (h *PublicHandler) VerifySignup(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	status, err := h.account.VerifySignupEmail(req.Token)
 	if err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
@@ -70,13 +111,31 @@ func (h *PublicHandler) Signup(c *gin.Context) {
 	c.JSON(http.StatusOK, gin.H{"ok": true, "status": status})
 }
 
-func (h *PublicHandler) ApproveSignup(c *gin.Context) {
-	var req struct{ ID string `json:"id"` }
+func (h *PublicHandler) ConfirmEmail(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if err := h.account.ConfirmEmail(req.Token); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"ok": true})
+}
+
+// CancelEmailChange takes the cancel token mailed to the old address.
+func (h *PublicHandler) CancelEmailChange(c *gin.Context) {
+	var req struct {
+		Token string `json:"token"`
+	}
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
-	if err := h.account.ApproveSignup(req.ID); err != nil {
+	if err := h.account.CancelEmailChange(req.Token); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
@@ -101,6 +160,18 @@ func (h *PublicHandler) ForgotPasswordSMS(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "phone required"})
 		return
 	}
+	// Limit per number however it is spelled.
+	if phone, err := h.account.NormalizePhone(req.Phone); err == nil {
+		req.Phone = phone
+	}
+	keys := []string{
+		service.LimitKey(service.LimitScopeSMSRequest, service.LimitKindIP, c.ClientIP()),
+		service.LimitKey(service.LimitScopeSMSRequest, service.LimitKindPhone, req.Phone),
+	}
+	if ok, wait := h.limiter.Allow(keys...); !ok {
+		tooManyRequests(c, wait)
+		return
+	}
 	_ = h.account.RequestSMSReset(req.Phone)
 	// Always return OK to not leak whether phone exists
 	c.JSON(http.StatusOK, gin.H{"ok": true, "message": "If a user is associated with this phone, a code was sent"})
@@ -120,9 +191,22 @@ func (h *PublicHandler) ResetPasswordSMS(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "phone, code, and newPassword required"})
 		return
 	}
+	if phone, err := h.account.NormalizePhone(req.Phone); err == nil {
+		req.Phone = phone
+	}
+	keys := []string{
+		service.LimitKey(service.LimitScopeSMSVerify, service.LimitKindIP, c.ClientIP()),
+		service.LimitKey(service.LimitScopeSMSVerify, service.LimitKindPhone, req.Phone),
+	}
+	if ok, wait := h.limiter.Allow(keys...); !ok {
+		tooManyRequests(c, wait)
+		return
+	}
 	if err := h.account.ResetPasswordSMS(req.Phone, req.Code, req.NewPassword); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
 		return
 	}
+	h.limiter.Undo(keys[0])
+	h.limiter.Success(keys[1])
 	c.JSON(http.StatusOK, gin.H{"ok": true})
 }
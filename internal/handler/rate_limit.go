@@ -0,0 +1,18 @@
+package handler
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// tooManyRequests rejects a rate limited request, telling the client when
+// it may try again.
+func tooManyRequests(c *gin.Context, wait time.Duration) {
+	secs := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(secs))
+	c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many attempts, try again later", "retryAfter": secs})
+}
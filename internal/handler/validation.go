@@ -0,0 +1,26 @@
+package handler
+
+import (
+	"errors"
+	"net/http"
+
+	"tinyauth-usermanagement/internal/service"
+
+	"github.com/gin-gonic/gin"
+)
+
+// badRequest rejects a request with err. Validation errors also carry the
+// offending field and a machine readable code; a taken username is a
+// conflict.
+func badRequest(c *gin.Context, err error) {
+	var ve *service.ValidationError
+	if errors.As(err, &ve) {
+		c.JSON(http.StatusBadRequest, ve)
+		return
+	}
+	if errors.Is(err, service.ErrUserExists) {
+		c.JSON(http.StatusConflict, gin.H{"error": err.Error()})
+		return
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+}
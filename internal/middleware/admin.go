@@ -0,0 +1,37 @@
+package middleware
+
+import (
+	"net/http"
+
+	"tinyauth-usermanagement/internal/service"
+	"tinyauth-usermanagement/internal/store"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminMiddleware only lets through sessions whose user still exists in
+// the users file and has the admin role in the metadata store. It must run
+// after SessionMiddleware.
+func AdminMiddleware(st store.Store, users *service.UserFileService) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		username := c.GetString("username")
+		if username == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		// An admin removed by editing the users file keeps their session
+		// until it expires, but not their admin access.
+		if _, ok, err := users.Find(username); err != nil {
+			c.AbortWithStatusJSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		} else if !ok {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			return
+		}
+		if store.RoleOf(st.GetUserMeta(username)) != store.RoleAdmin {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "forbidden"})
+			return
+		}
+		c.Next()
+	}
+}
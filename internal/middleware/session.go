@@ -10,7 +10,7 @@ import (
 	"github.com/gin-gonic/gin"
 )
 
-func SessionMiddleware(cfg config.Config, st *store.Store) gin.HandlerFunc {
+func SessionMiddleware(cfg config.Config, st store.Store) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		token, err := c.Cookie(cfg.SessionCookieName)
 		if err != nil || token == "" {
@@ -28,6 +28,7 @@ func SessionMiddleware(cfg config.Config, st *store.Store) gin.HandlerFunc {
 			return
 		}
 		c.Set("username", username)
+		c.Set("sessionToken", token)
 		c.Next()
 	}
 }
@@ -4,18 +4,173 @@ import (
 	"bytes"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
-	"io"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
+	"strings"
 	"text/template"
 	"time"
 )
 
 // SMSProvider is the interface for sending SMS messages.
 type SMSProvider interface {
-	SendSMS(to, message string) error
+	// SendSMS sends message to to, an E.164 number. Gateways that
+	// refuse the message return an *SMSError.
+	SendSMS(to, message string) (SMSDelivery, error)
+}
+
+// SMSDelivery describes a message a gateway accepted.
+type SMSDelivery struct {
+	// Provider names the adapter that sent the message, as in SMS_PROVIDER.
+	Provider string
+	// ID is the id the gateway gave the message, for looking it up in
+	// the gateway's logs. Empty if the gateway returns none.
+	ID string
+	// Failed lists the providers of a failover chain that were tried
+	// before Provider and failed.
+	Failed []string
+}
+
+// SMSStatusReporter is implemented by providers that track the health of
+// the gateways behind them.
+type SMSStatusReporter interface {
+	Status() []SMSProviderStatus
+}
+
+// SMSError is a message a gateway refused.
+type SMSError struct {
+	Provider string
+	// Status is the HTTP status of the response, or 0 for gateways that
+	// do not speak HTTP.
+	Status int
+	// Code and Message are the gateway's own error code and text, if it
+	// sent any.
+	Code    string
+	Message string
+	// Temporary reports whether the same message may go through later,
+	// as opposed to a bad number or bad credentials.
+	Temporary bool
+	// Recipient reports that the gateway refused the number, e.g. as
+	// invalid or barred, rather than failing itself.
+	Recipient bool
+}
+
+func (e *SMSError) Error() string {
+	var b strings.Builder
+	b.WriteString(e.Provider)
+	if e.Status != 0 {
+		fmt.Fprintf(&b, ": HTTP %d", e.Status)
+	}
+	if e.Code != "" {
+		fmt.Fprintf(&b, ": error %s", e.Code)
+	}
+	if e.Message != "" {
+		b.WriteString(": " + e.Message)
+	}
+	return b.String()
+}
+
+// SMS providers selectable through SMS_PROVIDER.
+const (
+	SMSProviderWebhook     = "webhook"
+	SMSProviderTwilio      = "twilio"
+	SMSProviderMessageBird = "messagebird"
+	SMSProviderVonage      = "vonage"
+	SMSProviderEmail       = "email"
+)
+
+// NewSMSProvider creates the providers listed in SMS_PROVIDER, comma
+// separated, from environment variables and chains them in that order
+// through a FailoverSMSProvider. Without SMS_PROVIDER the webhook provider
+// is used if SMS_ENABLED is set, as before adapters existed. Providers
+// whose configuration is invalid are left out. Returns nil if no provider
+// is left.
+func NewSMSProvider() SMSProvider {
+	var (
+		names     []string
+		providers []SMSProvider
+	)
+	raw := os.Getenv("SMS_PROVIDER")
+	if strings.TrimSpace(raw) == "" {
+		p := NewWebhookSMSProvider()
+		if p == nil {
+			return nil
+		}
+		names, providers = []string{SMSProviderWebhook}, []SMSProvider{p}
+	}
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(raw, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			log.Printf("[sms] %s is listed twice in SMS_PROVIDER", name)
+			continue
+		}
+		seen[name] = true
+		p, err := newNamedSMSProvider(name)
+		if err != nil {
+			log.Printf("[sms] %v", err)
+			continue
+		}
+		names, providers = append(names, name), append(providers, p)
+	}
+	if len(providers) == 0 {
+		return nil
+	}
+	log.Printf("[sms] SMS providers configured: %s", strings.Join(names, ", "))
+	return NewFailoverSMSProvider(failoverConfigFromEnv(), names, providers)
+}
+
+func newNamedSMSProvider(name string) (SMSProvider, error) {
+	switch name {
+	case SMSProviderWebhook:
+		if p := newWebhookSMSProvider(); p != nil {
+			return p, nil
+		}
+		return nil, errors.New("webhook: not configured")
+	case SMSProviderTwilio:
+		return NewTwilioSMSProvider(twilioConfigFromEnv())
+	case SMSProviderMessageBird:
+		return NewMessageBirdSMSProvider(messageBirdConfigFromEnv())
+	case SMSProviderVonage:
+		return NewVonageSMSProvider(vonageConfigFromEnv())
+	case SMSProviderEmail:
+		return NewEmailSMSProvider(emailSMSConfigFromEnv())
+	}
+	return nil, fmt.Errorf("unknown SMS provider %q in SMS_PROVIDER", name)
+}
+
+func failoverConfigFromEnv() SMSFailoverConfig {
+	return SMSFailoverConfig{
+		Threshold:   getenvInt("SMS_FAILOVER_THRESHOLD", 3),
+		Cooldown:    time.Duration(getenvInt("SMS_FAILOVER_COOLDOWN_SECONDS", 60)) * time.Second,
+		MaxCooldown: time.Duration(getenvInt("SMS_FAILOVER_MAX_COOLDOWN_SECONDS", 3600)) * time.Second,
+	}
+}
+
+// smsTimeout is SMS_TIMEOUT_SECONDS, the time a gateway gets to accept a
+// message.
+func smsTimeout() time.Duration {
+	return time.Duration(getenvInt("SMS_TIMEOUT_SECONDS", 15)) * time.Second
+}
+
+func getenvInt(key string, fallback int) int {
+	if n, err := strconv.Atoi(os.Getenv(key)); err == nil && n > 0 {
+		return n
+	}
+	return fallback
+}
+
+func getenvDefault(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
 }
 
 // WebhookSMSConfig holds the configuration for webhook-based SMS.
@@ -27,6 +182,7 @@ type WebhookSMSConfig struct {
 	Headers       map[string]string
 	Env           map[string]string
 	SkipTLSVerify bool
+	Timeout       time.Duration
 }
 
 // WebhookSMSProvider sends SMS via a configurable webhook.
@@ -41,7 +197,10 @@ func NewWebhookSMSProvider() SMSProvider {
 	if enabled == "" || (enabled != "1" && enabled != "true" && enabled != "yes") {
 		return nil
 	}
+	return newWebhookSMSProvider()
+}
 
+func newWebhookSMSProvider() SMSProvider {
 	url := os.Getenv("SMS_WEBHOOK_URL")
 	if url == "" {
 		log.Printf("[sms] SMS_ENABLED but SMS_WEBHOOK_URL not set")
@@ -93,12 +252,18 @@ func NewWebhookSMSProvider() SMSProvider {
 			Headers:       headers,
 			Env:           env,
 			SkipTLSVerify: skipTLS,
+			Timeout:       smsTimeout(),
 		},
 	}
 }
 
-// SendSMS sends an SMS message via the configured webhook.
-func (p *WebhookSMSProvider) SendSMS(to, message string) error {
+// SendSMS sends an SMS message via the configured webhook. The webhook
+// gives no delivery id.
+func (p *WebhookSMSProvider) SendSMS(to, message string) (SMSDelivery, error) {
+	return SMSDelivery{Provider: SMSProviderWebhook}, p.send(to, message)
+}
+
+func (p *WebhookSMSProvider) send(to, message string) error {
 	data := buildTemplateData(p.config.Env, map[string]string{
 		"To":      to,
 		"Message": message,
@@ -129,25 +294,20 @@ func (p *WebhookSMSProvider) SendSMS(to, message string) error {
 		req.Header.Set(k, headerVal)
 	}
 
-	client := &http.Client{Timeout: 15 * time.Second}
+	client := &http.Client{Timeout: p.config.Timeout}
 	if p.config.SkipTLSVerify {
 		client.Transport = &http.Transport{
 			TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
 		}
 	}
 
-	resp, err := client.Do(req)
+	status, respBody, err := doSMSRequest(client, req)
 	if err != nil {
-		return fmt.Errorf("http request: %w", err)
+		return err
 	}
-	defer resp.Body.Close()
-
-	respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
-	if resp.StatusCode >= 400 {
-		return fmt.Errorf("HTTP %d: %s", resp.StatusCode, string(respBody))
+	if status >= 400 {
+		return &SMSError{Provider: SMSProviderWebhook, Status: status, Message: truncate(string(respBody), 1024), Temporary: temporaryStatus(status)}
 	}
-
-	log.Printf("[sms] sent SMS to %s via webhook (HTTP %d)", to, resp.StatusCode)
 	return nil
 }
 
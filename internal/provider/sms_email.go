@@ -0,0 +1,168 @@
+package provider
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/jordan-wright/email"
+)
+
+// EmailSMSConfig configures EmailSMSProvider. The SMTP settings are the
+// SMTP_* ones mail is sent with.
+type EmailSMSConfig struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+	From     string
+	// To is a template for the gateway address of a number, with .To
+	// the E.164 number and .Number its digits, e.g.
+	// "{{.Number}}@sms.example.com".
+	To      string
+	Subject string
+	Timeout time.Duration
+}
+
+// EmailSMSProvider sends SMS through an email-to-SMS gateway. Gateways
+// answer nothing but the SMTP reply, so the delivery id is the Message-Id
+// of the mail.
+type EmailSMSProvider struct {
+	config EmailSMSConfig
+	to     *template.Template
+}
+
+func emailSMSConfigFromEnv() EmailSMSConfig {
+	port, err := strconv.Atoi(os.Getenv("SMTP_PORT"))
+	if err != nil {
+		port = 587
+	}
+	return EmailSMSConfig{
+		Host:     os.Getenv("SMTP_HOST"),
+		Port:     port,
+		Username: os.Getenv("SMTP_USERNAME"),
+		Password: os.Getenv("SMTP_PASSWORD"),
+		From:     getenvDefault("SMTP_FROM", "noreply@example.local"),
+		To:       os.Getenv("SMS_EMAIL_TO"),
+		Subject:  os.Getenv("SMS_EMAIL_SUBJECT"),
+		Timeout:  smsTimeout(),
+	}
+}
+
+// NewEmailSMSProvider checks cfg and creates the provider.
+func NewEmailSMSProvider(cfg EmailSMSConfig) (*EmailSMSProvider, error) {
+	if cfg.Host == "" {
+		return nil, errors.New("email: SMTP_HOST is required")
+	}
+	if cfg.To == "" {
+		return nil, errors.New("email: SMS_EMAIL_TO is required")
+	}
+	to, err := template.New("to").Option("missingkey=error").Parse(cfg.To)
+	if err != nil {
+		return nil, fmt.Errorf("email: SMS_EMAIL_TO: %w", err)
+	}
+	if cfg.Port == 0 {
+		cfg.Port = 587
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 15 * time.Second
+	}
+	return &EmailSMSProvider{config: cfg, to: to}, nil
+}
+
+// SendSMS mails message to the gateway address of to.
+func (p *EmailSMSProvider) SendSMS(to, message string) (SMSDelivery, error) {
+	var rcpt bytes.Buffer
+	if err := p.to.Execute(&rcpt, map[string]string{"To": to, "Number": smsDigits(to)}); err != nil {
+		return SMSDelivery{}, fmt.Errorf("template to: %w", err)
+	}
+
+	e := email.NewEmail()
+	e.From = p.config.From
+	e.To = []string{rcpt.String()}
+	e.Subject = p.config.Subject
+	e.Text = []byte(message)
+	from, err := mail.ParseAddress(p.config.From)
+	if err != nil {
+		return SMSDelivery{}, fmt.Errorf("SMTP_FROM: %w", err)
+	}
+	domain := "localhost"
+	if i := strings.LastIndexByte(from.Address, '@'); i >= 0 {
+		domain = from.Address[i+1:]
+	}
+	id := uuid.NewString() + "@" + domain
+	e.Headers.Set("Message-Id", "<"+id+">")
+	raw, err := e.Bytes()
+	if err != nil {
+		return SMSDelivery{}, err
+	}
+
+	if err := p.send(from.Address, rcpt.String(), raw); err != nil {
+		var tpErr *textproto.Error
+		if errors.As(err, &tpErr) {
+			return SMSDelivery{}, &SMSError{Provider: SMSProviderEmail, Code: strconv.Itoa(tpErr.Code),
+				Message: tpErr.Msg, Temporary: tpErr.Code >= 400 && tpErr.Code < 500}
+		}
+		return SMSDelivery{}, err
+	}
+	return SMSDelivery{Provider: SMSProviderEmail, ID: id}, nil
+}
+
+// send is smtp.SendMail with a deadline for the whole conversation.
+func (p *EmailSMSProvider) send(from, to string, msg []byte) error {
+	addr := net.JoinHostPort(p.config.Host, strconv.Itoa(p.config.Port))
+	conn, err := net.DialTimeout("tcp", addr, p.config.Timeout)
+	if err != nil {
+		return fmt.Errorf("smtp dial: %w", err)
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(p.config.Timeout)); err != nil {
+		return err
+	}
+	c, err := smtp.NewClient(conn, p.config.Host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: p.config.Host}); err != nil {
+			return err
+		}
+	}
+	if p.config.Username != "" {
+		if err := c.Auth(smtp.PlainAuth("", p.config.Username, p.config.Password, p.config.Host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
@@ -0,0 +1,155 @@
+package provider
+
+import (
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// smtpStub is a minimal SMTP server that accepts one message per
+// connection, or answers RCPT with rcptReply when it is set.
+type smtpStub struct {
+	rcptReply string
+
+	mu   sync.Mutex
+	from string
+	to   string
+	data string
+}
+
+func startSMTPStub(t *testing.T, rcptReply string) (*smtpStub, string, int) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	s := &smtpStub{rcptReply: rcptReply}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	addr := ln.Addr().(*net.TCPAddr)
+	return s, addr.IP.String(), addr.Port
+}
+
+func (s *smtpStub) serve(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 stub ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 stub")
+		case "MAIL":
+			s.mu.Lock()
+			s.from = line
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			if s.rcptReply != "" {
+				tp.PrintfLine("%s", s.rcptReply)
+				continue
+			}
+			s.mu.Lock()
+			s.to = line
+			s.mu.Unlock()
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.mu.Lock()
+			s.data = string(data)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func newTestEmailSMS(t *testing.T, host string, port int) *EmailSMSProvider {
+	t.Helper()
+	p, err := NewEmailSMSProvider(EmailSMSConfig{Host: host, Port: port, From: "Auth <auth@example.com>",
+		To: "{{.Number}}@sms.example.net", Subject: "code"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestEmailSendSMS(t *testing.T) {
+	stub, host, port := startSMTPStub(t, "")
+	d, err := newTestEmailSMS(t, host, port).SendSMS("+4915112345678", "your code is 123456")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Provider != SMSProviderEmail || !strings.HasSuffix(d.ID, "@example.com") {
+		t.Fatalf("got delivery %+v", d)
+	}
+	stub.mu.Lock()
+	defer stub.mu.Unlock()
+	if stub.from != "MAIL FROM:<auth@example.com>" || !strings.HasPrefix(stub.to, "RCPT TO:<4915112345678@sms.example.net>") {
+		t.Fatalf("got %q, %q", stub.from, stub.to)
+	}
+	if !strings.Contains(stub.data, "Message-Id: <"+d.ID+">") || !strings.Contains(stub.data, "your code is 123456") {
+		t.Fatalf("got message %q", stub.data)
+	}
+}
+
+func TestEmailSendSMSErrors(t *testing.T) {
+	tests := []struct {
+		name  string
+		reply string
+		want  SMSError
+	}{
+		{
+			name:  "permanent",
+			reply: "550 5.1.1 mailbox unavailable",
+			want:  SMSError{Provider: SMSProviderEmail, Code: "550", Message: "5.1.1 mailbox unavailable"},
+		},
+		{
+			name:  "temporary",
+			reply: "451 4.3.0 try again later",
+			want:  SMSError{Provider: SMSProviderEmail, Code: "451", Message: "4.3.0 try again later", Temporary: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, host, port := startSMTPStub(t, tt.reply)
+			_, err := newTestEmailSMS(t, host, port).SendSMS("+4915112345678", "hello")
+			wantSMSError(t, err, tt.want)
+		})
+	}
+}
+
+func TestEmailSendSMSUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	_, err = newTestEmailSMS(t, "127.0.0.1", port).SendSMS("+4915112345678", "hello")
+	if err == nil || !strings.Contains(err.Error(), "smtp dial") {
+		t.Fatalf("got error %v, want a dial error", err)
+	}
+}
@@ -0,0 +1,199 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SMSFailoverConfig configures the circuit breaker of FailoverSMSProvider.
+type SMSFailoverConfig struct {
+	// Threshold is the number of failures in a row after which a provider
+	// is skipped.
+	Threshold int
+	// Cooldown is how long a provider is skipped before it gets another
+	// try. Each failed retry doubles it, up to MaxCooldown.
+	Cooldown    time.Duration
+	MaxCooldown time.Duration
+}
+
+// SMSProviderStatus is the health of one provider of a failover chain.
+type SMSProviderStatus struct {
+	Name string `json:"name"`
+	// State is "closed" while the provider is used, "open" while it is
+	// skipped and "half-open" once its cooldown is over and the next
+	// message will tell whether it recovered.
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutiveFailures"`
+	OpenUntil           int64  `json:"openUntil,omitempty"`
+	LastSuccessAt       int64  `json:"lastSuccessAt,omitempty"`
+	LastFailureAt       int64  `json:"lastFailureAt,omitempty"`
+	LastError           string `json:"lastError,omitempty"`
+	Sent                int    `json:"sent"`
+	Failed              int    `json:"failed"`
+}
+
+// Circuit breaker states reported in SMSProviderStatus.
+const (
+	SMSCircuitClosed   = "closed"
+	SMSCircuitOpen     = "open"
+	SMSCircuitHalfOpen = "half-open"
+)
+
+type smsMember struct {
+	name     string
+	provider SMSProvider
+	status   SMSProviderStatus
+	cooldown time.Duration
+}
+
+// FailoverSMSProvider tries an ordered list of providers until one accepts
+// the message. A circuit breaker per provider skips those that keep
+// failing until their cooldown is over.
+type FailoverSMSProvider struct {
+	config  SMSFailoverConfig
+	mu      sync.Mutex
+	members []*smsMember
+	now     func() time.Time
+}
+
+// NewFailoverSMSProvider chains providers in the order of names.
+func NewFailoverSMSProvider(cfg SMSFailoverConfig, names []string, providers []SMSProvider) *FailoverSMSProvider {
+	if cfg.Threshold <= 0 {
+		cfg.Threshold = 3
+	}
+	if cfg.Cooldown <= 0 {
+		cfg.Cooldown = time.Minute
+	}
+	if cfg.MaxCooldown < cfg.Cooldown {
+		cfg.MaxCooldown = cfg.Cooldown
+	}
+	f := &FailoverSMSProvider{config: cfg, now: time.Now}
+	for i, p := range providers {
+		f.members = append(f.members, &smsMember{name: names[i], provider: p,
+			status: SMSProviderStatus{Name: names[i]}, cooldown: cfg.Cooldown})
+	}
+	return f
+}
+
+// SendSMS sends message through the first provider that accepts it,
+// skipping providers whose circuit is open. If every circuit is open, all
+// providers are tried anyway, since a message that may fail beats one that
+// is never sent. The delivery names the provider that sent the message and
+// those that failed before it.
+func (f *FailoverSMSProvider) SendSMS(to, message string) (SMSDelivery, error) {
+	var (
+		tried []string
+		errs  []error
+	)
+	attempt := func(m *smsMember) (SMSDelivery, bool) {
+		d, err := m.provider.SendSMS(to, message)
+		f.record(m, err)
+		if err != nil {
+			tried = append(tried, m.name)
+			errs = append(errs, fmt.Errorf("%s: %w", m.name, err))
+			return SMSDelivery{}, false
+		}
+		d.Provider, d.Failed = m.name, tried
+		return d, true
+	}
+
+	var skipped []*smsMember
+	for _, m := range f.members {
+		if !f.available(m) {
+			skipped = append(skipped, m)
+			continue
+		}
+		if d, ok := attempt(m); ok {
+			return d, nil
+		}
+	}
+	if len(skipped) == len(f.members) {
+		for _, m := range skipped {
+			if d, ok := attempt(m); ok {
+				return d, nil
+			}
+		}
+	}
+	if len(errs) == 0 {
+		return SMSDelivery{}, errors.New("no SMS provider available")
+	}
+	return SMSDelivery{}, fmt.Errorf("all SMS providers failed: %w", errors.Join(errs...))
+}
+
+// available reports whether m's circuit lets a message through.
+func (f *FailoverSMSProvider) available(m *smsMember) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return m.status.OpenUntil == 0 || !f.now().Before(time.Unix(m.status.OpenUntil, 0))
+}
+
+// record updates the health of m after a send that ended with err.
+func (f *FailoverSMSProvider) record(m *smsMember, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	st := &m.status
+	if err == nil {
+		st.Sent++
+		st.LastSuccessAt = now.Unix()
+		st.ConsecutiveFailures, st.OpenUntil = 0, 0
+		m.cooldown = f.config.Cooldown
+		return
+	}
+	st.Failed++
+	st.LastFailureAt, st.LastError = now.Unix(), err.Error()
+	if !providerFault(err) {
+		return
+	}
+	st.ConsecutiveFailures++
+	switch {
+	case st.OpenUntil != 0:
+		// A retry after the cooldown failed: skip it for longer.
+		m.cooldown = min(2*m.cooldown, f.config.MaxCooldown)
+		st.OpenUntil = now.Add(m.cooldown).Unix()
+	case st.ConsecutiveFailures >= f.config.Threshold:
+		st.OpenUntil = now.Add(m.cooldown).Unix()
+	}
+}
+
+// providerFault reports whether err says something about the provider
+// rather than the message. A gateway refusing a number as invalid is no
+// reason to stop using it.
+func providerFault(err error) bool {
+	var se *SMSError
+	if !errors.As(err, &se) || se.Temporary {
+		return true
+	}
+	if se.Recipient {
+		return false
+	}
+	switch se.Status {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusUnprocessableEntity:
+		return false
+	}
+	return true
+}
+
+// Status returns the health of each provider, in order.
+func (f *FailoverSMSProvider) Status() []SMSProviderStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := f.now()
+	res := make([]SMSProviderStatus, 0, len(f.members))
+	for _, m := range f.members {
+		st := m.status
+		switch {
+		case st.OpenUntil == 0:
+			st.State = SMSCircuitClosed
+		case now.Before(time.Unix(st.OpenUntil, 0)):
+			st.State = SMSCircuitOpen
+		default:
+			st.State = SMSCircuitHalfOpen
+		}
+		res = append(res, st)
+	}
+	return res
+}
@@ -0,0 +1,60 @@
+package provider
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// maxSMSResponse caps how much of a gateway response is read.
+const maxSMSResponse = 64 << 10
+
+// doSMSRequest sends req and returns the status and body of the response.
+// It only fails if the gateway could not be reached or its response read.
+func doSMSRequest(client *http.Client, req *http.Request) (int, []byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("http request: %w", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxSMSResponse))
+	if err != nil {
+		return 0, nil, fmt.Errorf("read response: %w", err)
+	}
+	return resp.StatusCode, body, nil
+}
+
+// temporaryStatus reports whether an HTTP status means the gateway may
+// accept the message later: rate limits and server errors.
+func temporaryStatus(status int) bool {
+	return status == http.StatusTooManyRequests || status >= 500
+}
+
+// smsDigits returns an E.164 number without its "+", as most gateways
+// want it.
+func smsDigits(to string) string {
+	return strings.TrimPrefix(to, "+")
+}
+
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	return s[:n] + "..."
+}
+
+// jsonCode renders an error code that gateways send as a number or a
+// string.
+func jsonCode(raw json.RawMessage) string {
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s
+	}
+	var n json.Number
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n.String()
+	}
+	return ""
+}
@@ -0,0 +1,59 @@
+package provider
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// stubRequest is what a stub gateway received.
+type stubRequest struct {
+	Method string
+	Path   string
+	Header http.Header
+	Body   string
+}
+
+// stubGateway starts a server that answers every request with status and
+// body, and records the last request it got.
+func stubGateway(t *testing.T, status int, contentType, body string) (*httptest.Server, *stubRequest) {
+	t.Helper()
+	got := &stubRequest{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := io.ReadAll(r.Body)
+		*got = stubRequest{Method: r.Method, Path: r.URL.Path, Header: r.Header.Clone(), Body: string(b)}
+		w.Header().Set("Content-Type", contentType)
+		w.WriteHeader(status)
+		io.WriteString(w, body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv, got
+}
+
+// wantSMSError checks that err is an *SMSError matching want.
+func wantSMSError(t *testing.T, err error, want SMSError) {
+	t.Helper()
+	var e *SMSError
+	if !errors.As(err, &e) {
+		t.Fatalf("got error %v, want an *SMSError", err)
+	}
+	if *e != want {
+		t.Fatalf("got %#v, want %#v", *e, want)
+	}
+}
+
+func TestJSONCode(t *testing.T) {
+	for raw, want := range map[string]string{
+		`21211`:   "21211",
+		`"21211"`: "21211",
+		`"E42"`:   "E42",
+		`null`:    "",
+		`{}`:      "",
+	} {
+		if got := jsonCode([]byte(raw)); got != want {
+			t.Errorf("jsonCode(%s) = %q, want %q", raw, got, want)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// MessageBirdSMSConfig configures MessageBirdSMSProvider.
+type MessageBirdSMSConfig struct {
+	AccessKey string
+	// Originator is the sender shown on the phone: a number or up to 11
+	// letters.
+	Originator string
+	// BaseURL defaults to https://rest.messagebird.com.
+	BaseURL string
+	Timeout time.Duration
+}
+
+// MessageBirdSMSProvider sends SMS as JSON to the MessageBird messages API.
+type MessageBirdSMSProvider struct {
+	config MessageBirdSMSConfig
+	client *http.Client
+}
+
+func messageBirdConfigFromEnv() MessageBirdSMSConfig {
+	return MessageBirdSMSConfig{
+		AccessKey:  os.Getenv("SMS_MESSAGEBIRD_ACCESS_KEY"),
+		Originator: os.Getenv("SMS_FROM"),
+		BaseURL:    getenvDefault("SMS_MESSAGEBIRD_BASE_URL", "https://rest.messagebird.com"),
+		Timeout:    smsTimeout(),
+	}
+}
+
+// NewMessageBirdSMSProvider checks cfg and creates the provider.
+func NewMessageBirdSMSProvider(cfg MessageBirdSMSConfig) (*MessageBirdSMSProvider, error) {
+	if cfg.AccessKey == "" {
+		return nil, errors.New("messagebird: SMS_MESSAGEBIRD_ACCESS_KEY is required")
+	}
+	if cfg.Originator == "" {
+		return nil, errors.New("messagebird: SMS_FROM is required")
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = "https://rest.messagebird.com"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 15 * time.Second
+	}
+	return &MessageBirdSMSProvider{config: cfg, client: &http.Client{Timeout: cfg.Timeout}}, nil
+}
+
+type messageBirdResponse struct {
+	ID     string `json:"id"`
+	Errors []struct {
+		Code        json.RawMessage `json:"code"`
+		Description string          `json:"description"`
+		Parameter   string          `json:"parameter"`
+	} `json:"errors"`
+}
+
+// SendSMS sends message to to and returns the message id.
+func (p *MessageBirdSMSProvider) SendSMS(to, message string) (SMSDelivery, error) {
+	payload, err := json.Marshal(map[string]any{
+		"recipients": []string{smsDigits(to)},
+		"originator": p.config.Originator,
+		"body":       message,
+	})
+	if err != nil {
+		return SMSDelivery{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(p.config.BaseURL, "/")+"/messages", bytes.NewReader(payload))
+	if err != nil {
+		return SMSDelivery{}, fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", "AccessKey "+p.config.AccessKey)
+
+	status, body, err := doSMSRequest(p.client, req)
+	if err != nil {
+		return SMSDelivery{}, err
+	}
+	var res messageBirdResponse
+	jsonErr := json.Unmarshal(body, &res)
+	if status >= 300 || jsonErr != nil || res.ID == "" {
+		e := &SMSError{Provider: SMSProviderMessageBird, Status: status, Temporary: temporaryStatus(status)}
+		switch {
+		case jsonErr != nil:
+			e.Message = truncate(string(body), 1024)
+		case len(res.Errors) > 0:
+			first := res.Errors[0]
+			e.Code, e.Message = jsonCode(first.Code), first.Description
+			if first.Parameter != "" {
+				e.Message += " (" + first.Parameter + ")"
+			}
+		}
+		return SMSDelivery{}, e
+	}
+	return SMSDelivery{Provider: SMSProviderMessageBird, ID: res.ID}, nil
+}
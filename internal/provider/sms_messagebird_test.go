@@ -0,0 +1,79 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func newTestMessageBird(t *testing.T, baseURL string) *MessageBirdSMSProvider {
+	t.Helper()
+	p, err := NewMessageBirdSMSProvider(MessageBirdSMSConfig{AccessKey: "live_key", Originator: "Example", BaseURL: baseURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestMessageBirdSendSMS(t *testing.T) {
+	srv, got := stubGateway(t, http.StatusCreated, "application/json", `{"id":"e8077d803532c0b5937c639b60216938","recipients":{"totalCount":1}}`)
+	d, err := newTestMessageBird(t, srv.URL).SendSMS("+4915112345678", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Provider != SMSProviderMessageBird || d.ID != "e8077d803532c0b5937c639b60216938" {
+		t.Fatalf("got delivery %+v", d)
+	}
+	if got.Method != http.MethodPost || got.Path != "/messages" {
+		t.Fatalf("got %s %s", got.Method, got.Path)
+	}
+	if auth := got.Header.Get("Authorization"); auth != "AccessKey live_key" {
+		t.Fatalf("got Authorization %q", auth)
+	}
+	var payload struct {
+		Recipients []string `json:"recipients"`
+		Originator string   `json:"originator"`
+		Body       string   `json:"body"`
+	}
+	if err := json.Unmarshal([]byte(got.Body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if len(payload.Recipients) != 1 || payload.Recipients[0] != "4915112345678" || payload.Originator != "Example" || payload.Body != "hello" {
+		t.Fatalf("got payload %+v", payload)
+	}
+}
+
+func TestMessageBirdSendSMSErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   SMSError
+	}{
+		{
+			name:   "numeric code",
+			status: http.StatusUnprocessableEntity,
+			body:   `{"errors":[{"code":9,"description":"no (correct) recipients found","parameter":"recipient"}]}`,
+			want:   SMSError{Provider: SMSProviderMessageBird, Status: 422, Code: "9", Message: "no (correct) recipients found (recipient)"},
+		},
+		{
+			name:   "string code",
+			status: http.StatusUnauthorized,
+			body:   `{"errors":[{"code":"2","description":"Request not allowed (incorrect access_key)"}]}`,
+			want:   SMSError{Provider: SMSProviderMessageBird, Status: 401, Code: "2", Message: "Request not allowed (incorrect access_key)"},
+		},
+		{
+			name:   "non-JSON body",
+			status: http.StatusServiceUnavailable,
+			body:   "upstream connect error",
+			want:   SMSError{Provider: SMSProviderMessageBird, Status: 503, Message: "upstream connect error", Temporary: true},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := stubGateway(t, tt.status, "application/json", tt.body)
+			_, err := newTestMessageBird(t, srv.URL).SendSMS("+4915112345678", "hello")
+			wantSMSError(t, err, tt.want)
+		})
+	}
+}
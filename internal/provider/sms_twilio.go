@@ -0,0 +1,104 @@
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// TwilioSMSConfig configures TwilioSMSProvider. Other gateways that copy
+// Twilio's Messages API work too by changing BaseURL.
+type TwilioSMSConfig struct {
+	AccountSID string
+	AuthToken  string
+	// From is the sending number. It may be left empty when
+	// MessagingServiceSID is set.
+	From                string
+	MessagingServiceSID string
+	// BaseURL defaults to https://api.twilio.com.
+	BaseURL string
+	Timeout time.Duration
+}
+
+// TwilioSMSProvider sends SMS as form posts to the Twilio Messages API.
+type TwilioSMSProvider struct {
+	config TwilioSMSConfig
+	client *http.Client
+}
+
+func twilioConfigFromEnv() TwilioSMSConfig {
+	return TwilioSMSConfig{
+		AccountSID:          os.Getenv("SMS_TWILIO_ACCOUNT_SID"),
+		AuthToken:           os.Getenv("SMS_TWILIO_AUTH_TOKEN"),
+		From:                os.Getenv("SMS_FROM"),
+		MessagingServiceSID: os.Getenv("SMS_TWILIO_MESSAGING_SERVICE_SID"),
+		BaseURL:             getenvDefault("SMS_TWILIO_BASE_URL", "https://api.twilio.com"),
+		Timeout:             smsTimeout(),
+	}
+}
+
+// NewTwilioSMSProvider checks cfg and creates the provider.
+func NewTwilioSMSProvider(cfg TwilioSMSConfig) (*TwilioSMSProvider, error) {
+	if cfg.AccountSID == "" || cfg.AuthToken == "" {
+		return nil, errors.New("twilio: SMS_TWILIO_ACCOUNT_SID and SMS_TWILIO_AUTH_TOKEN are required")
+	}
+	if cfg.From == "" && cfg.MessagingServiceSID == "" {
+		return nil, errors.New("twilio: SMS_FROM or SMS_TWILIO_MESSAGING_SERVICE_SID is required")
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = "https://api.twilio.com"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 15 * time.Second
+	}
+	return &TwilioSMSProvider{config: cfg, client: &http.Client{Timeout: cfg.Timeout}}, nil
+}
+
+// twilioResponse holds the fields of a Twilio message or error resource
+// that are used here.
+type twilioResponse struct {
+	SID     string          `json:"sid"`
+	Code    json.RawMessage `json:"code"`
+	Message string          `json:"message"`
+}
+
+// SendSMS sends message to to and returns the message SID.
+func (p *TwilioSMSProvider) SendSMS(to, message string) (SMSDelivery, error) {
+	form := url.Values{"To": {to}, "Body": {message}}
+	if p.config.MessagingServiceSID != "" {
+		form.Set("MessagingServiceSid", p.config.MessagingServiceSID)
+	} else {
+		form.Set("From", p.config.From)
+	}
+	endpoint := fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json",
+		strings.TrimRight(p.config.BaseURL, "/"), url.PathEscape(p.config.AccountSID))
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return SMSDelivery{}, fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	req.SetBasicAuth(p.config.AccountSID, p.config.AuthToken)
+
+	status, body, err := doSMSRequest(p.client, req)
+	if err != nil {
+		return SMSDelivery{}, err
+	}
+	var res twilioResponse
+	jsonErr := json.Unmarshal(body, &res)
+	if status >= 300 || jsonErr != nil || res.SID == "" {
+		e := &SMSError{Provider: SMSProviderTwilio, Status: status, Temporary: temporaryStatus(status)}
+		if jsonErr == nil {
+			e.Code, e.Message = jsonCode(res.Code), res.Message
+		} else {
+			e.Message = truncate(string(body), 1024)
+		}
+		return SMSDelivery{}, e
+	}
+	return SMSDelivery{Provider: SMSProviderTwilio, ID: res.SID}, nil
+}
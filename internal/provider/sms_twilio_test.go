@@ -0,0 +1,81 @@
+package provider
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func newTestTwilio(t *testing.T, baseURL string) *TwilioSMSProvider {
+	t.Helper()
+	p, err := NewTwilioSMSProvider(TwilioSMSConfig{AccountSID: "AC123", AuthToken: "secret", From: "+15550001111", BaseURL: baseURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestTwilioSendSMS(t *testing.T) {
+	srv, got := stubGateway(t, http.StatusCreated, "application/json", `{"sid":"SM0123","status":"queued"}`)
+	d, err := newTestTwilio(t, srv.URL).SendSMS("+4915112345678", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Provider != SMSProviderTwilio || d.ID != "SM0123" {
+		t.Fatalf("got delivery %+v", d)
+	}
+	if got.Method != http.MethodPost || got.Path != "/2010-04-01/Accounts/AC123/Messages.json" {
+		t.Fatalf("got %s %s", got.Method, got.Path)
+	}
+	form, err := url.ParseQuery(got.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if form.Get("To") != "+4915112345678" || form.Get("From") != "+15550001111" || form.Get("Body") != "hello" {
+		t.Fatalf("got form %v", form)
+	}
+	if user, pass, ok := (&http.Request{Header: got.Header}).BasicAuth(); !ok || user != "AC123" || pass != "secret" {
+		t.Fatalf("got basic auth %q %q", user, pass)
+	}
+}
+
+func TestTwilioSendSMSErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   SMSError
+	}{
+		{
+			name:   "numeric code",
+			status: http.StatusBadRequest,
+			body:   `{"code":21211,"message":"Invalid 'To' Phone Number","status":400}`,
+			want:   SMSError{Provider: SMSProviderTwilio, Status: 400, Code: "21211", Message: "Invalid 'To' Phone Number"},
+		},
+		{
+			name:   "string code",
+			status: http.StatusTooManyRequests,
+			body:   `{"code":"20429","message":"Too Many Requests"}`,
+			want:   SMSError{Provider: SMSProviderTwilio, Status: 429, Code: "20429", Message: "Too Many Requests", Temporary: true},
+		},
+		{
+			name:   "non-JSON body",
+			status: http.StatusBadGateway,
+			body:   "<html>Bad Gateway</html>",
+			want:   SMSError{Provider: SMSProviderTwilio, Status: 502, Message: "<html>Bad Gateway</html>", Temporary: true},
+		},
+		{
+			name:   "success without sid",
+			status: http.StatusOK,
+			body:   `{}`,
+			want:   SMSError{Provider: SMSProviderTwilio, Status: 200},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := stubGateway(t, tt.status, "application/json", tt.body)
+			_, err := newTestTwilio(t, srv.URL).SendSMS("+4915112345678", "hello")
+			wantSMSError(t, err, tt.want)
+		})
+	}
+}
@@ -0,0 +1,114 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// VonageSMSConfig configures VonageSMSProvider.
+type VonageSMSConfig struct {
+	APIKey    string
+	APISecret string
+	// From is the sender shown on the phone: a number or up to 11
+	// letters.
+	From string
+	// BaseURL defaults to https://rest.nexmo.com.
+	BaseURL string
+	Timeout time.Duration
+}
+
+// VonageSMSProvider sends SMS as JSON to the Vonage (Nexmo) SMS API.
+type VonageSMSProvider struct {
+	config VonageSMSConfig
+	client *http.Client
+}
+
+func vonageConfigFromEnv() VonageSMSConfig {
+	return VonageSMSConfig{
+		APIKey:    os.Getenv("SMS_VONAGE_API_KEY"),
+		APISecret: os.Getenv("SMS_VONAGE_API_SECRET"),
+		From:      os.Getenv("SMS_FROM"),
+		BaseURL:   getenvDefault("SMS_VONAGE_BASE_URL", "https://rest.nexmo.com"),
+		Timeout:   smsTimeout(),
+	}
+}
+
+// NewVonageSMSProvider checks cfg and creates the provider.
+func NewVonageSMSProvider(cfg VonageSMSConfig) (*VonageSMSProvider, error) {
+	if cfg.APIKey == "" || cfg.APISecret == "" {
+		return nil, errors.New("vonage: SMS_VONAGE_API_KEY and SMS_VONAGE_API_SECRET are required")
+	}
+	if cfg.From == "" {
+		return nil, errors.New("vonage: SMS_FROM is required")
+	}
+	if cfg.BaseURL == "" {
+		cfg.BaseURL = "https://rest.nexmo.com"
+	}
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = 15 * time.Second
+	}
+	return &VonageSMSProvider{config: cfg, client: &http.Client{Timeout: cfg.Timeout}}, nil
+}
+
+// vonageResponse is the reply of the SMS API. It answers HTTP 200 for
+// refused messages too; the status of each message part tells. Statuses
+// are documented as strings, but some compatible gateways send numbers.
+type vonageResponse struct {
+	Messages []struct {
+		MessageID string          `json:"message-id"`
+		Status    json.RawMessage `json:"status"`
+		ErrorText string          `json:"error-text"`
+	} `json:"messages"`
+}
+
+// vonageTemporary are the message statuses worth retrying: throttled and
+// internal error.
+var vonageTemporary = map[string]bool{"1": true, "5": true}
+
+// vonageRecipient are the message statuses that blame the number: invalid
+// parameters (mostly an invalid to), unroutable, barred, non-whitelisted
+// destination and deactivated number.
+var vonageRecipient = map[string]bool{"3": true, "6": true, "7": true, "29": true, "33": true}
+
+// SendSMS sends message to to and returns the id of its first part.
+func (p *VonageSMSProvider) SendSMS(to, message string) (SMSDelivery, error) {
+	payload, err := json.Marshal(map[string]string{
+		"api_key":    p.config.APIKey,
+		"api_secret": p.config.APISecret,
+		"from":       p.config.From,
+		"to":         smsDigits(to),
+		"text":       message,
+	})
+	if err != nil {
+		return SMSDelivery{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(p.config.BaseURL, "/")+"/sms/json", bytes.NewReader(payload))
+	if err != nil {
+		return SMSDelivery{}, fmt.Errorf("new request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+
+	status, body, err := doSMSRequest(p.client, req)
+	if err != nil {
+		return SMSDelivery{}, err
+	}
+	var res vonageResponse
+	if err := json.Unmarshal(body, &res); err != nil || status >= 300 || len(res.Messages) == 0 {
+		return SMSDelivery{}, &SMSError{Provider: SMSProviderVonage, Status: status,
+			Message: truncate(string(body), 1024), Temporary: temporaryStatus(status)}
+	}
+	for _, m := range res.Messages {
+		if code := jsonCode(m.Status); code != "0" {
+			return SMSDelivery{}, &SMSError{Provider: SMSProviderVonage, Status: status,
+				Code: code, Message: m.ErrorText, Temporary: vonageTemporary[code], Recipient: vonageRecipient[code]}
+		}
+	}
+	return SMSDelivery{Provider: SMSProviderVonage, ID: res.Messages[0].MessageID}, nil
+}
@@ -0,0 +1,86 @@
+package provider
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func newTestVonage(t *testing.T, baseURL string) *VonageSMSProvider {
+	t.Helper()
+	p, err := NewVonageSMSProvider(VonageSMSConfig{APIKey: "key", APISecret: "secret", From: "Example", BaseURL: baseURL})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestVonageSendSMS(t *testing.T) {
+	srv, got := stubGateway(t, http.StatusOK, "application/json",
+		`{"message-count":"1","messages":[{"to":"4915112345678","message-id":"0A0000000123ABCD1","status":"0"}]}`)
+	d, err := newTestVonage(t, srv.URL).SendSMS("+4915112345678", "hello")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Provider != SMSProviderVonage || d.ID != "0A0000000123ABCD1" {
+		t.Fatalf("got delivery %+v", d)
+	}
+	if got.Method != http.MethodPost || got.Path != "/sms/json" {
+		t.Fatalf("got %s %s", got.Method, got.Path)
+	}
+	var payload map[string]string
+	if err := json.Unmarshal([]byte(got.Body), &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload["api_key"] != "key" || payload["api_secret"] != "secret" || payload["from"] != "Example" ||
+		payload["to"] != "4915112345678" || payload["text"] != "hello" {
+		t.Fatalf("got payload %v", payload)
+	}
+}
+
+func TestVonageSendSMSErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		status int
+		body   string
+		want   SMSError
+	}{
+		{
+			name:   "string status",
+			status: http.StatusOK,
+			body:   `{"message-count":"1","messages":[{"status":"1","error-text":"Throttled"}]}`,
+			want:   SMSError{Provider: SMSProviderVonage, Status: 200, Code: "1", Message: "Throttled", Temporary: true},
+		},
+		{
+			name:   "numeric status",
+			status: http.StatusOK,
+			body:   `{"message-count":"1","messages":[{"status":6,"error-text":"Unroutable message - rejected"}]}`,
+			want:   SMSError{Provider: SMSProviderVonage, Status: 200, Code: "6", Message: "Unroutable message - rejected", Recipient: true},
+		},
+		{
+			name:   "bad credentials",
+			status: http.StatusOK,
+			body:   `{"message-count":"1","messages":[{"status":"4","error-text":"Bad Credentials"}]}`,
+			want:   SMSError{Provider: SMSProviderVonage, Status: 200, Code: "4", Message: "Bad Credentials"},
+		},
+		{
+			name:   "non-JSON body",
+			status: http.StatusInternalServerError,
+			body:   "Internal Server Error",
+			want:   SMSError{Provider: SMSProviderVonage, Status: 500, Message: "Internal Server Error", Temporary: true},
+		},
+		{
+			name:   "no messages",
+			status: http.StatusOK,
+			body:   `{"message-count":"0","messages":[]}`,
+			want:   SMSError{Provider: SMSProviderVonage, Status: 200, Message: `{"message-count":"0","messages":[]}`},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv, _ := stubGateway(t, tt.status, "application/json", tt.body)
+			_, err := newTestVonage(t, srv.URL).SendSMS("+4915112345678", "hello")
+			wantSMSError(t, err, tt.want)
+		})
+	}
+}
@@ -8,6 +8,7 @@ import (
 	"log"
 	"math/big"
 	"strings"
+	"sync"
 	"time"
 
 	"tinyauth-usermanagement/internal/config"
@@ -22,32 +23,77 @@ import (
 
 type AccountService struct {
 	cfg             config.Config
-	store           *store.Store
+	store           store.Store
 	users           *UserFileService
 	mail            *MailService
-	docker          *DockerService
+	reload          *ReloadService
 	passwordTargets *provider.PasswordTargetProvider
 	sms             provider.SMSProvider
+	names           UsernamePolicy
+	phones          PhonePolicy
+
+	// signupMu serialises signup decisions, so a signup is approved once.
+	signupMu sync.Mutex
 }
 
-func NewAccountService(cfg config.Config, st *store.Store, users *UserFileService, mail *MailService, docker *DockerService, passwordTargets *provider.PasswordTargetProvider, sms provider.SMSProvider) *AccountService {
-	return &AccountService{cfg: cfg, store: st, users: users, mail: mail, docker: docker, passwordTargets: passwordTargets, sms: sms}
+func NewAccountService(cfg config.Config, st store.Store, users *UserFileService, mail *MailService, reload *ReloadService, passwordTargets *provider.PasswordTargetProvider, sms provider.SMSProvider) *AccountService {
+	return &AccountService{cfg: cfg, store: st, users: users, mail: mail, reload: reload, passwordTargets: passwordTargets, sms: sms, names: NewUsernamePolicy(cfg), phones: NewPhonePolicy(cfg)}
 }
 
-func (s *AccountService) RequestPasswordReset(username string) error {
+// RequestPasswordReset mails a reset link for the user named identifier
+// or, failing that, to every user with identifier as email address. It
+// never reports whether any user matched.
+func (s *AccountService) RequestPasswordReset(identifier string) error {
+	identifier = strings.TrimSpace(identifier)
+	var usernames []string
+	if u, ok, err := s.users.Find(identifier); err != nil {
+		return err
+	} else if ok {
+		usernames = []string{u.Username}
+	} else if strings.Contains(identifier, "@") {
+		if usernames, err = s.store.FindUsersByEmail(identifier); err != nil {
+			return err
+		}
+	}
+	for _, username := range usernames {
+		if err := s.SendPasswordReset(username); err != nil {
+			log.Printf("[reset] %s: %v", username, err)
+		}
+	}
+	return nil // don't leak
+}
+
+// SendPasswordReset mails a reset link to the email address of username.
+func (s *AccountService) SendPasswordReset(username string) error {
 	u, ok, err := s.users.Find(username)
 	if err != nil {
 		return err
 	}
 	if !ok {
-		return nil // don't leak
+		return errors.New("user not found")
+	}
+	to := s.resetRecipient(u.Username)
+	if to == "" {
+		return errors.New("no email address on file")
 	}
 	token := uuid.NewString()
 	exp := time.Now().Add(time.Duration(s.cfg.ResetTokenTTLSeconds) * time.Second).Unix()
 	if err := s.store.CreateResetToken(token, u.Username, exp); err != nil {
 		return err
 	}
-	return s.mail.SendResetEmail(u.Username, token)
+	return s.mail.SendResetEmail(to, token)
+}
+
+// resetRecipient is the Email of username or, for users without one, the
+// username itself if it is an email address.
+func (s *AccountService) resetRecipient(username string) string {
+	if meta := s.store.GetUserMeta(username); meta != nil && meta.Email != "" {
+		return meta.Email
+	}
+	if addr, err := normalizeEmail(username); err == nil && strings.Contains(addr, "@") {
+		return addr
+	}
+	return ""
 }
 
 func (s *AccountService) ResetPassword(token, newPassword string) error {
@@ -77,7 +123,7 @@ func (s *AccountService) ResetPassword(token, newPassword string) error {
 		return err
 	}
 	_ = s.store.MarkResetTokenUsed(token)
-	s.docker.RestartTinyauth()
+	s.reload.Request()
 	s.syncPasswordTargets(username, newPassword, hash)
 	return nil
 }
@@ -87,52 +133,233 @@ func (s *AccountService) Signup(username, email, password string) (string, error
 }
 
 func (s *AccountService) SignupWithPhone(username, email, password, phone string) (string, error) {
-	if username == "" || password == "" {
+	username, err := s.names.Normalize(username)
+	if err != nil {
+		return "", err
+	}
+	if password == "" {
 		return "", errors.New("username and password required")
 	}
-	if existing, ok, err := s.users.Find(username); err != nil {
+	if _, ok, err := s.users.Find(username); err != nil {
 		return "", err
-	} else if ok && existing.Username != "" {
-		return "", errors.New("user already exists")
+	} else if ok {
+		return "", ErrUserExists
 	}
 	hash, err := HashPassword(password)
 	if err != nil {
 		return "", err
 	}
+	if email, err = normalizeEmail(email); err != nil {
+		return "", err
+	}
+	if phone, err = s.phones.Normalize(phone); err != nil {
+		return "", err
+	}
+	if s.cfg.SignupVerifyEmail {
+		return s.signupUnverified(username, email, phone, hash)
+	}
 	if s.cfg.SignupRequireApproval {
-		id := uuid.NewString()
-		if err := s.store.CreatePendingSignup(id, username, email, hash, time.Now().Unix()); err != nil {
+		ps := store.PendingSignup{ID: uuid.NewString(), Username: username, Email: email, Phone: phone, PasswordHash: hash, EmailVerified: true, CreatedAt: time.Now().Unix()}
+		ps.ExpiresAt = s.approvalExpiry(ps.CreatedAt)
+		if err := s.store.CreatePendingSignup(ps); err != nil {
 			return "", err
 		}
-		if phone != "" {
-			_ = s.store.SetPhone(username, phone)
+		return ps.ID, nil
+	}
+	if err := s.users.Create(UserRecord{Username: username, Password: hash}); err != nil {
+		return "", err
+	}
+	s.setSignupMeta(username, &store.UserMeta{Phone: phone, Email: email})
+	s.reload.Request()
+	s.syncPasswordTargets(username, password, hash)
+	return SignupStatusApproved, nil
+}
+
+// Signup statuses other than the id of a signup waiting for approval.
+const (
+	SignupStatusVerifyEmail     = "verify_email"
+	SignupStatusPendingApproval = "pending_approval"
+	SignupStatusApproved        = "approved"
+)
+
+// signupUnverified keeps a signup until its email address is confirmed
+// through the link sent to it.
+func (s *AccountService) signupUnverified(username, email, phone, hash string) (string, error) {
+	if email == "" {
+		return "", &ValidationError{Field: "email", Code: ValidationRequired, Message: "email required"}
+	}
+	now := time.Now().Unix()
+	ps := store.PendingSignup{ID: uuid.NewString(), Username: username, Email: email, Phone: phone, PasswordHash: hash,
+		CreatedAt: now, ExpiresAt: now + s.cfg.SignupVerifyTTLSeconds}
+	if err := s.store.CreatePendingSignup(ps); err != nil {
+		return "", err
+	}
+	token := signToken(s.cfg.SessionSecret, tokenPurposeSignup, ps.ID, ps.ExpiresAt)
+	if err := s.mail.SendSignupVerification(email, username, token); err != nil {
+		_ = s.store.DeletePendingSignup(ps.ID)
+		log.Printf("[signup] send verification to %s: %v", email, err)
+		return "", errors.New("failed to send verification email")
+	}
+	return SignupStatusVerifyEmail, nil
+}
+
+// VerifySignupEmail confirms the email address of a signup through the
+// token from the verification link. The signup then waits for approval
+// or, if approval is off, becomes a user right away. It returns
+// SignupStatusPendingApproval or SignupStatusApproved.
+func (s *AccountService) VerifySignupEmail(token string) (string, error) {
+	now := time.Now().Unix()
+	id, err := verifyToken(s.cfg.SessionSecret, tokenPurposeSignup, token, now)
+	if err != nil {
+		return "", err
+	}
+	s.signupMu.Lock()
+	defer s.signupMu.Unlock()
+	ps, err := s.pendingSignup(id)
+	if err != nil {
+		return "", errInvalidLink
+	}
+	if s.cfg.SignupRequireApproval {
+		if !ps.EmailVerified {
+			if err := s.store.MarkPendingSignupVerified(id, s.approvalExpiry(now)); err != nil {
+				return "", err
+			}
+			log.Printf("[signup] %s verified %s", ps.Username, ps.Email)
 		}
-		return id, nil
+		return SignupStatusPendingApproval, nil
 	}
-	if err := s.users.Upsert(UserRecord{Username: username, Password: hash}); err != nil {
+	if err := s.activateSignup(ps, false); err != nil {
 		return "", err
 	}
-	if phone != "" {
-		_ = s.store.SetPhone(username, phone)
+	log.Printf("[signup] %s verified %s and was activated", ps.Username, ps.Email)
+	return SignupStatusApproved, nil
+}
+
+// approvalExpiry is when a signup waiting for approval since now expires.
+func (s *AccountService) approvalExpiry(now int64) int64 {
+	if s.cfg.SignupTTLSeconds <= 0 {
+		return 0
 	}
-	s.docker.RestartTinyauth()
-	s.syncPasswordTargets(username, password, hash)
-	return "approved", nil
+	return now + s.cfg.SignupTTLSeconds
+}
+
+// PendingSignups lists the signups waiting for approval, oldest first.
+func (s *AccountService) PendingSignups() ([]store.PendingSignup, error) {
+	all, err := s.store.ListPendingSignups()
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now().Unix()
+	res := all[:0]
+	for _, ps := range all {
+		if !signupExpired(ps, now) {
+			res = append(res, ps)
+		}
+	}
+	return res, nil
+}
+
+// ApproveSignup creates the user of a pending signup and removes the
+// signup. It never overwrites a user created in the meantime; such a
+// signup stays pending until it is rejected.
+func (s *AccountService) ApproveSignup(id, reason string) error {
+	s.signupMu.Lock()
+	defer s.signupMu.Unlock()
+	ps, err := s.pendingSignup(id)
+	if err != nil {
+		return err
+	}
+	if !ps.EmailVerified {
+		return errors.New("email address not verified yet")
+	}
+	if err := s.activateSignup(ps, true); err != nil {
+		return err
+	}
+	log.Printf("[signup] approved %s", ps.Username)
+	s.notifySignup(ps, true, reason)
+	return nil
+}
+
+// activateSignup turns a signup into a user and removes it. approved
+// records an admin approval in the metadata.
+func (s *AccountService) activateSignup(ps *store.PendingSignup, approved bool) error {
+	if err := s.users.Create(UserRecord{Username: ps.Username, Password: ps.PasswordHash}); err != nil {
+		return err
+	}
+	if err := s.store.DeletePendingSignup(ps.ID); err != nil {
+		log.Printf("[signup] remove signup %s: %v", ps.ID, err)
+	}
+	meta := &store.UserMeta{Approved: approved, Phone: ps.Phone, Email: ps.Email}
+	if ps.Email != "" && s.cfg.SignupVerifyEmail {
+		meta.EmailVerifiedAt = time.Now().Unix()
+	}
+	s.setSignupMeta(ps.Username, meta)
+	s.reload.Request()
+	return nil
+}
+
+// setSignupMeta stores the metadata of a new user. A phone number given at
+// signup is stored unverified, so it never conflicts with the number of
+// another user and is not trusted until the user confirms it by SMS.
+func (s *AccountService) setSignupMeta(username string, meta *store.UserMeta) {
+	if err := newAccount(s.store, username, meta); err != nil {
+		log.Printf("[signup] save metadata of %s: %v", username, err)
+	}
+}
+
+// newAccount stores the metadata of a user just added to the users file.
+// It replaces whatever an earlier user of that name left behind when they
+// were removed without DeleteUser, e.g. by editing the users file or a
+// rollback, so the new user inherits neither their role nor their sessions.
+func newAccount(st store.Store, username string, meta *store.UserMeta) error {
+	if err := st.DeleteUserTokens(username); err != nil {
+		return err
+	}
+	return st.SetUserMeta(username, meta)
 }
 
-func (s *AccountService) ApproveSignup(id string) error {
-	username, hash, err := s.store.GetPendingSignup(id)
+// RejectSignup drops a pending signup.
+func (s *AccountService) RejectSignup(id, reason string) error {
+	s.signupMu.Lock()
+	defer s.signupMu.Unlock()
+	ps, err := s.pendingSignup(id)
 	if err != nil {
 		return err
 	}
-	if err := s.users.Upsert(UserRecord{Username: username, Password: hash}); err != nil {
+	if err := s.store.DeletePendingSignup(id); err != nil {
 		return err
 	}
-	_ = s.store.ApprovePendingSignup(id)
-	s.docker.RestartTinyauth()
+	log.Printf("[signup] rejected %s", ps.Username)
+	s.notifySignup(ps, false, reason)
 	return nil
 }
 
+// pendingSignup returns a signup that has not expired yet.
+func (s *AccountService) pendingSignup(id string) (*store.PendingSignup, error) {
+	ps, err := s.store.GetPendingSignup(id)
+	if err != nil {
+		return nil, err
+	}
+	if signupExpired(*ps, time.Now().Unix()) {
+		_ = s.store.DeletePendingSignup(id)
+		return nil, errors.New("signup expired")
+	}
+	return ps, nil
+}
+
+func signupExpired(ps store.PendingSignup, now int64) bool {
+	return ps.ExpiresAt > 0 && now > ps.ExpiresAt
+}
+
+func (s *AccountService) notifySignup(ps *store.PendingSignup, approved bool, reason string) {
+	if ps.Email == "" {
+		return
+	}
+	if err := s.mail.SendSignupDecision(ps.Email, ps.Username, approved, strings.TrimSpace(reason)); err != nil {
+		log.Printf("[signup] notify %s: %v", ps.Email, err)
+	}
+}
+
 func (s *AccountService) Profile(username string) (map[string]any, error) {
 	u, ok, err := s.users.Find(username)
 	if err != nil {
@@ -142,17 +369,31 @@ func (s *AccountService) Profile(username string) (map[string]any, error) {
 		return nil, errors.New("not found")
 	}
 	phone, _ := s.store.GetPhone(username)
+	meta := s.store.GetUserMeta(u.Username)
+	recoveryCodes := 0
+	if meta != nil {
+		recoveryCodes = len(meta.RecoveryCodes)
+	}
+	var email, pendingEmail, pendingPhone string
+	var emailVerified, phoneVerified bool
+	if meta != nil {
+		email, pendingEmail, emailVerified = meta.Email, meta.PendingEmail, meta.EmailVerifiedAt > 0
+		pendingPhone, phoneVerified = meta.PendingPhone, meta.PhoneVerifiedAt > 0
+	}
 	return map[string]any{
-		"username":    u.Username,
-		"totpEnabled": strings.TrimSpace(u.TotpSecret) != "",
-		"phone":       phone,
+		"username":               u.Username,
+		"totpEnabled":            strings.TrimSpace(u.TotpSecret) != "",
+		"phone":                  phone,
+		"phoneVerified":          phoneVerified,
+		"pendingPhone":           pendingPhone,
+		"email":                  email,
+		"emailVerified":          emailVerified,
+		"pendingEmail":           pendingEmail,
+		"role":                   store.RoleOf(meta),
+		"recoveryCodesRemaining": recoveryCodes,
 	}, nil
 }
 
-func (s *AccountService) SetPhone(username, phone string) error {
-	return s.store.SetPhone(username, phone)
-}
-
 func (s *AccountService) ChangePassword(username, oldPassword, newPassword string) error {
 	u, ok, err := s.users.Find(username)
 	if err != nil {
@@ -172,18 +413,22 @@ func (s *AccountService) ChangePassword(username, oldPassword, newPassword strin
 	if err := s.users.Upsert(u); err != nil {
 		return err
 	}
-	s.docker.RestartTinyauth()
+	s.reload.Request()
 	s.syncPasswordTargets(username, newPassword, hash)
 	return nil
 }
 
 // syncPasswordTargets sends password to all configured webhook targets (fire and forget).
 func (s *AccountService) syncPasswordTargets(username, plainPassword, hashedPassword string) {
-	if s.passwordTargets == nil {
+	syncPasswordTargets(s.passwordTargets, username, plainPassword, hashedPassword)
+}
+
+func syncPasswordTargets(targets *provider.PasswordTargetProvider, username, plainPassword, hashedPassword string) {
+	if targets == nil {
 		return
 	}
 	go func() {
-		errs := s.passwordTargets.SyncPassword(username, plainPassword, hashedPassword)
+		errs := targets.SyncPassword(username, plainPassword, hashedPassword)
 		for _, err := range errs {
 			log.Printf("[password-targets] sync error: %v", err)
 		}
@@ -195,7 +440,7 @@ func (s *AccountService) RequestSMSReset(phone string) error {
 	if s.sms == nil {
 		return errors.New("SMS not configured")
 	}
-	username, err := s.store.FindUserByPhone(phone)
+	username, err := s.verifiedPhoneUser(phone)
 	if err != nil {
 		return err
 	}
@@ -216,20 +461,40 @@ func (s *AccountService) RequestSMSReset(phone string) error {
 	}
 
 	msg := fmt.Sprintf("Your password reset code is: %s (valid for 10 minutes)", code)
-	if err := s.sms.SendSMS(phone, msg); err != nil {
+	return s.sendSMS(phone, msg)
+}
+
+// sendSMS texts message to phone and logs how it went. Gateway errors are
+// only logged; callers get a generic error.
+func (s *AccountService) sendSMS(phone, message string) error {
+	d, err := s.sms.SendSMS(phone, message)
+	if err != nil {
 		log.Printf("[sms] failed to send SMS to %s: %v", phone, err)
-		return fmt.Errorf("failed to send SMS")
+		return errors.New("failed to send SMS")
 	}
-
+	via := d.Provider
+	if d.ID != "" {
+		via += " (id " + d.ID + ")"
+	}
+	if len(d.Failed) > 0 {
+		via += " after " + strings.Join(d.Failed, ", ") + " failed"
+	}
+	log.Printf("[sms] sent SMS to %s via %s", phone, via)
 	return nil
 }
 
 // ResetPasswordSMS verifies a code and resets the password.
 func (s *AccountService) ResetPasswordSMS(phone, code, newPassword string) error {
-	username, err := s.store.VerifySMSResetCode(phone, code)
+	username, err := s.verifiedPhoneUser(phone)
 	if err != nil {
 		return err
 	}
+	if username == "" {
+		return errors.New("no user with that phone")
+	}
+	if err := s.store.VerifySMSResetCode(username, code, s.cfg.SMSCodeMaxAttempts); err != nil {
+		return err
+	}
 
 	hash, err := HashPassword(newPassword)
 	if err != nil {
@@ -248,7 +513,7 @@ func (s *AccountService) ResetPasswordSMS(phone, code, newPassword string) error
 		return err
 	}
 
-	s.docker.RestartTinyauth()
+	s.reload.Request()
 	s.syncPasswordTargets(username, newPassword, hash)
 	return nil
 }
@@ -258,11 +523,26 @@ func (s *AccountService) SMSEnabled() bool {
 	return s.sms != nil
 }
 
-func (s *AccountService) TotpSetup(username string) (secret, otpURL string, pngBytes []byte, err error) {
+// SMSStatus returns the health of each SMS provider, or nil if the
+// provider does not track it.
+func (s *AccountService) SMSStatus() []provider.SMSProviderStatus {
+	if r, ok := s.sms.(provider.SMSStatusReporter); ok {
+		return r.Status()
+	}
+	return nil
+}
+
+// TotpSetup generates a new secret and keeps it as the pending enrollment
+// of the session until TotpEnable or TotpRecover confirms it.
+func (s *AccountService) TotpSetup(username, sessionToken string) (secret, otpURL string, pngBytes []byte, err error) {
 	key, err := totp.Generate(totp.GenerateOpts{Issuer: s.cfg.TOTPIssuer, AccountName: username})
 	if err != nil {
 		return "", "", nil, err
 	}
+	now := time.Now().Unix()
+	if err := s.store.CreateTOTPEnrollment(sessionToken, username, key.Secret(), now, now+s.cfg.TOTPEnrollTTLSeconds); err != nil {
+		return "", "", nil, err
+	}
 	img, err := key.Image(256, 256)
 	if err != nil {
 		return "", "", nil, err
@@ -279,23 +559,94 @@ type bytesBuffer struct{ b []byte }
 func (w *bytesBuffer) Write(p []byte) (int, error) { w.b = append(w.b, p...); return len(p), nil }
 func (w *bytesBuffer) Bytes() []byte               { return w.b }
 
-func (s *AccountService) TotpEnable(username, secret, code string) error {
-	if !totp.Validate(code, secret) {
-		return errors.New("invalid code")
+// pendingTotpSecret returns the secret from the session's pending
+// enrollment, which must belong to username and not be expired.
+func (s *AccountService) pendingTotpSecret(username, sessionToken string) (string, error) {
+	owner, secret, expiresAt, err := s.store.GetTOTPEnrollment(sessionToken)
+	if err != nil {
+		return "", err
+	}
+	if owner == "" || owner != username {
+		return "", errors.New("no pending totp setup")
 	}
+	if time.Now().Unix() > expiresAt {
+		_ = s.store.DeleteTOTPEnrollment(sessionToken)
+		return "", errors.New("totp setup expired")
+	}
+	return secret, nil
+}
+
+// TotpEnable confirms the session's pending enrollment once code proves
+// the authenticator is set up. It returns a fresh set of recovery codes,
+// which are only ever shown this once.
+func (s *AccountService) TotpEnable(username, sessionToken, code string) ([]string, error) {
+	secret, err := s.pendingTotpSecret(username, sessionToken)
+	if err != nil {
+		return nil, err
+	}
+	if !totp.Validate(strings.TrimSpace(code), secret) {
+		return nil, errors.New("invalid code")
+	}
+	return s.enableTotp(username, sessionToken, secret)
+}
+
+func (s *AccountService) enableTotp(username, sessionToken, secret string) ([]string, error) {
 	u, ok, err := s.users.Find(username)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if !ok {
-		return errors.New("not found")
+		return nil, errors.New("not found")
+	}
+	codes, hashes, err := generateRecoveryCodes(s.cfg.TOTPRecoveryCodeCount)
+	if err != nil {
+		return nil, err
 	}
 	u.TotpSecret = secret
 	if err := s.users.Upsert(u); err != nil {
-		return err
+		return nil, err
 	}
-	s.docker.RestartTinyauth()
-	return nil
+	_ = s.store.DeleteTOTPEnrollment(sessionToken)
+	if err := setRecoveryCodes(s.store, u.Username, hashes); err != nil {
+		return nil, err
+	}
+	unlock := lockUserMeta(u.Username)
+	if meta := s.store.GetUserMeta(u.Username); meta != nil {
+		meta.TOTPEnrolledAt = time.Now().Unix()
+		if err := s.store.SetUserMeta(u.Username, meta); err != nil {
+			log.Printf("[totp] failed to record enrollment time for %s: %v", u.Username, err)
+		}
+	}
+	unlock()
+	log.Printf("[totp] %s enrolled a new authenticator", u.Username)
+	s.reload.Request()
+	return codes, nil
+}
+
+// RegenerateRecoveryCodes replaces all recovery codes of a user with TOTP
+// enabled and returns the new ones.
+func (s *AccountService) RegenerateRecoveryCodes(username, password string) ([]string, error) {
+	u, ok, err := s.users.Find(username)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("not found")
+	}
+	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
+		return nil, errors.New("invalid password")
+	}
+	if strings.TrimSpace(u.TotpSecret) == "" {
+		return nil, errors.New("totp not enabled")
+	}
+	codes, hashes, err := generateRecoveryCodes(s.cfg.TOTPRecoveryCodeCount)
+	if err != nil {
+		return nil, err
+	}
+	if err := setRecoveryCodes(s.store, u.Username, hashes); err != nil {
+		return nil, err
+	}
+	return codes, nil
 }
 
 func (s *AccountService) TotpDisable(username, password string) error {
@@ -313,15 +664,33 @@ func (s *AccountService) TotpDisable(username, password string) error {
 	if err := s.users.Upsert(u); err != nil {
 		return err
 	}
-	s.docker.RestartTinyauth()
+	if err := setRecoveryCodes(s.store, u.Username, nil); err != nil {
+		return err
+	}
+	s.reload.Request()
 	return nil
 }
 
-func (s *AccountService) TotpRecover(username, recoveryKey, newSecret, code string) error {
-	if recoveryKey != fmt.Sprintf("RECOVERY-%s", username) {
-		return errors.New("invalid recovery key")
+// TotpRecover re-enrolls a user who lost their authenticator, confirming
+// the session's pending enrollment. It consumes one recovery code and
+// returns a new set.
+func (s *AccountService) TotpRecover(username, sessionToken, recoveryCode, code string) ([]string, error) {
+	secret, err := s.pendingTotpSecret(username, sessionToken)
+	if err != nil {
+		return nil, err
+	}
+	if !totp.Validate(strings.TrimSpace(code), secret) {
+		return nil, errors.New("invalid code")
 	}
-	return s.TotpEnable(username, newSecret, code)
+	ok, err := consumeRecoveryCode(s.store, username, recoveryCode)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("invalid recovery code")
+	}
+	log.Printf("[totp] %s used a recovery code to re-enroll", username)
+	return s.enableTotp(username, sessionToken, secret)
 }
 
 func (s *AccountService) ValidateToken(token string) (*otp.Key, error) {
@@ -340,3 +709,19 @@ func generateNumericCode(length int) (string, error) {
 	}
 	return string(code), nil
 }
+
+const passwordAlphabet = "abcdefghijkmnopqrstuvwxyzABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+
+// generatePassword generates a random password of the given length from an
+// alphabet without look-alike characters.
+func generatePassword(length int) (string, error) {
+	b := make([]byte, length)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, big.NewInt(int64(len(passwordAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		b[i] = passwordAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
@@ -0,0 +1,633 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"tinyauth-usermanagement/internal/config"
+	"tinyauth-usermanagement/internal/provider"
+	"tinyauth-usermanagement/internal/store"
+)
+
+// AdminUser is a users file record joined with its stored metadata.
+type AdminUser struct {
+	Username      string `json:"username"`
+	Name          string `json:"name"`
+	Role          string `json:"role"`
+	Phone         string `json:"phone"`
+	PhoneVerified bool   `json:"phoneVerified"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"emailVerified"`
+	TotpEnabled   bool   `json:"totpEnabled"`
+}
+
+// AdminUserCreate describes a new user. Password is required unless
+// GeneratePassword is set.
+type AdminUserCreate struct {
+	Username         string `json:"username"`
+	Password         string `json:"password"`
+	GeneratePassword bool   `json:"generatePassword"`
+	Name             string `json:"name"`
+	Role             string `json:"role"`
+	Phone            string `json:"phone"`
+	Email            string `json:"email"`
+}
+
+// UserFilter narrows ListUsers. Zero fields match everyone.
+type UserFilter struct {
+	// Query matches a substring of the username, name, email or phone,
+	// ignoring case.
+	Query string
+	Role  string
+	Totp  *bool
+}
+
+func (f UserFilter) match(u AdminUser) bool {
+	if f.Role != "" && u.Role != f.Role {
+		return false
+	}
+	if f.Totp != nil && u.TotpEnabled != *f.Totp {
+		return false
+	}
+	if q := strings.ToLower(strings.TrimSpace(f.Query)); q != "" {
+		return strings.Contains(strings.ToLower(u.Username), q) ||
+			strings.Contains(strings.ToLower(u.Name), q) ||
+			strings.Contains(strings.ToLower(u.Email), q) ||
+			strings.Contains(u.Phone, q)
+	}
+	return true
+}
+
+// generatedPasswordLength is the length of passwords generated for users
+// created by an admin.
+const generatedPasswordLength = 20
+
+// AdminUserUpdate describes a partial update of a user. Nil fields are left as-is.
+type AdminUserUpdate struct {
+	Username *string `json:"username"`
+	Password *string `json:"password"`
+	Name     *string `json:"name"`
+	Role     *string `json:"role"`
+	Phone    *string `json:"phone"`
+	Email    *string `json:"email"`
+}
+
+// ImportUser is one row of a bulk import. Either Password (plain text) or
+// PasswordHash (bcrypt) must be set.
+type ImportUser struct {
+	Username     string `json:"username"`
+	Password     string `json:"password"`
+	PasswordHash string `json:"passwordHash"`
+	Name         string `json:"name"`
+	Role         string `json:"role"`
+	Phone        string `json:"phone"`
+	Email        string `json:"email"`
+}
+
+// ImportResult reports what happened to one ImportUser.
+type ImportResult struct {
+	Username string `json:"username"`
+	Status   string `json:"status"` // created, updated, skipped or error
+	Error    string `json:"error,omitempty"`
+}
+
+type AdminService struct {
+	cfg             config.Config
+	store           store.Store
+	users           *UserFileService
+	account         *AccountService
+	reload          *ReloadService
+	passwordTargets *provider.PasswordTargetProvider
+	names           UsernamePolicy
+	phones          PhonePolicy
+}
+
+func NewAdminService(cfg config.Config, st store.Store, users *UserFileService, account *AccountService, reload *ReloadService, passwordTargets *provider.PasswordTargetProvider) *AdminService {
+	return &AdminService{cfg: cfg, store: st, users: users, account: account, reload: reload, passwordTargets: passwordTargets, names: NewUsernamePolicy(cfg), phones: NewPhonePolicy(cfg)}
+}
+
+// ListUsers returns the users matching filter, sorted by username.
+func (s *AdminService) ListUsers(filter UserFilter) ([]AdminUser, error) {
+	records, err := s.users.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	metas := s.store.ListUserMeta()
+	res := make([]AdminUser, 0, len(records))
+	for _, u := range records {
+		if au := s.toAdminUser(u, metas[u.Username]); filter.match(au) {
+			res = append(res, au)
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return strings.ToLower(res[i].Username) < strings.ToLower(res[j].Username) })
+	return res, nil
+}
+
+func (s *AdminService) GetUser(username string) (AdminUser, error) {
+	u, ok, err := s.users.Find(username)
+	if err != nil {
+		return AdminUser{}, err
+	}
+	if !ok {
+		return AdminUser{}, errors.New("not found")
+	}
+	var meta store.UserMeta
+	if m := s.store.GetUserMeta(u.Username); m != nil {
+		meta = *m
+	}
+	return s.toAdminUser(u, meta), nil
+}
+
+// CreateUser adds a user. If a password was generated it is returned, so
+// that the admin can hand it over; it is not stored anywhere in plain text.
+func (s *AdminService) CreateUser(req AdminUserCreate) (AdminUser, string, error) {
+	username, err := s.names.Normalize(req.Username)
+	if err != nil {
+		return AdminUser{}, "", err
+	}
+	password, generated := req.Password, ""
+	if req.GeneratePassword {
+		if password != "" {
+			return AdminUser{}, "", errors.New("password and generatePassword are exclusive")
+		}
+		if generated, err = generatePassword(generatedPasswordLength); err != nil {
+			return AdminUser{}, "", err
+		}
+		password = generated
+	}
+	if password == "" {
+		return AdminUser{}, "", errors.New("username and password required")
+	}
+	if !validRole(req.Role) {
+		return AdminUser{}, "", errors.New("invalid role")
+	}
+	if req.Email, err = normalizeEmail(req.Email); err != nil {
+		return AdminUser{}, "", err
+	}
+	if req.Phone, err = s.phones.Normalize(req.Phone); err != nil {
+		return AdminUser{}, "", err
+	}
+	if err := checkPhoneFree(s.store, username, req.Phone); err != nil {
+		return AdminUser{}, "", err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return AdminUser{}, "", err
+	}
+	if err := s.users.Create(UserRecord{Username: username, Password: hash}); err != nil {
+		return AdminUser{}, "", err
+	}
+	meta := &store.UserMeta{Name: req.Name, Role: req.Role, Phone: req.Phone, Email: req.Email, Approved: true}
+	if err := newAccount(s.store, username, meta); err != nil {
+		return AdminUser{}, "", phoneTaken(err)
+	}
+	s.reload.Request()
+	syncPasswordTargets(s.passwordTargets, username, password, hash)
+	log.Printf("[admin] created user %s", username)
+	u, err := s.GetUser(username)
+	return u, generated, err
+}
+
+// UpdateUser applies a partial update. actor is the admin performing the
+// change and may not revoke their own admin role.
+func (s *AdminService) UpdateUser(actor, username string, upd AdminUserUpdate) (AdminUser, error) {
+	u, ok, err := s.users.Find(username)
+	if err != nil {
+		return AdminUser{}, err
+	}
+	if !ok {
+		return AdminUser{}, errors.New("not found")
+	}
+	if upd.Role != nil {
+		if !validRole(*upd.Role) {
+			return AdminUser{}, errors.New("invalid role")
+		}
+		if u.Username == actor && *upd.Role != store.RoleAdmin {
+			return AdminUser{}, errors.New("cannot remove your own admin role")
+		}
+	}
+	if upd.Email != nil {
+		email, err := normalizeEmail(*upd.Email)
+		if err != nil {
+			return AdminUser{}, err
+		}
+		upd.Email = &email
+	}
+	if upd.Phone != nil {
+		phone, err := s.phones.Normalize(*upd.Phone)
+		if err != nil {
+			return AdminUser{}, err
+		}
+		if err := checkPhoneFree(s.store, u.Username, phone); err != nil {
+			return AdminUser{}, err
+		}
+		upd.Phone = &phone
+	}
+	if upd.Password != nil && *upd.Password == "" {
+		return AdminUser{}, errors.New("password must not be empty")
+	}
+	newName := u.Username
+	if upd.Username != nil {
+		if newName, err = s.names.Normalize(*upd.Username); err != nil {
+			return AdminUser{}, err
+		}
+		if newName != u.Username && u.Username == actor {
+			return AdminUser{}, errors.New("cannot rename your own account")
+		}
+	}
+
+	// Metadata is written before the rename: it is the step that fails
+	// on a phone number taken meanwhile, and the easier one to put back
+	// if the rename fails, so a failed update changes nothing.
+	unlock := lockUserMeta(u.Username)
+	prev := s.store.GetUserMeta(u.Username)
+	metaChanged := upd.Name != nil || upd.Role != nil || upd.Phone != nil || upd.Email != nil
+	if metaChanged {
+		meta := &store.UserMeta{}
+		if prev != nil {
+			m := *prev
+			meta = &m
+		}
+		if upd.Name != nil {
+			meta.Name = *upd.Name
+		}
+		if upd.Role != nil {
+			meta.Role = *upd.Role
+		}
+		if upd.Phone != nil && *upd.Phone != meta.Phone {
+			meta.Phone, meta.PhoneVerifiedAt = *upd.Phone, 0
+			clearPendingPhone(meta)
+		}
+		if upd.Email != nil && !strings.EqualFold(*upd.Email, meta.Email) {
+			meta.Email, meta.EmailVerifiedAt = *upd.Email, 0
+		}
+		if err := s.store.SetUserMeta(u.Username, meta); err != nil {
+			unlock()
+			return AdminUser{}, phoneTaken(err)
+		}
+	}
+	if newName != u.Username {
+		if err := s.rename(u.Username, newName); err != nil {
+			if metaChanged {
+				s.restoreMeta(u.Username, prev)
+			}
+			unlock()
+			return AdminUser{}, err
+		}
+		u.Username = newName
+	}
+	unlock()
+
+	if upd.Password != nil {
+		hash, err := HashPassword(*upd.Password)
+		if err != nil {
+			return AdminUser{}, err
+		}
+		u.Password = hash
+		if err := s.users.Upsert(u); err != nil {
+			return AdminUser{}, err
+		}
+		s.reload.Request()
+		syncPasswordTargets(s.passwordTargets, u.Username, *upd.Password, hash)
+	}
+	return s.GetUser(u.Username)
+}
+
+// rename moves a user and their metadata to newName and ends their
+// sessions. Those and any reset links or codes still refer to the old name
+// and are dropped, so they cannot be used by a new user of that name.
+func (s *AdminService) rename(oldName, newName string) error {
+	if err := s.users.Rename(oldName, newName); err != nil {
+		return err
+	}
+	if meta := s.store.GetUserMeta(oldName); meta != nil {
+		if err := s.store.SetUserMeta(newName, meta); err != nil {
+			return err
+		}
+		if err := s.store.DeleteUserMeta(oldName); err != nil {
+			return err
+		}
+	}
+	if err := s.store.DeleteUserTokens(oldName); err != nil {
+		return err
+	}
+	s.reload.Request()
+	log.Printf("[admin] renamed user %s to %s", oldName, newName)
+	return nil
+}
+
+// restoreMeta puts back the metadata of username as it was before a failed
+// update; prev is nil if there was none.
+func (s *AdminService) restoreMeta(username string, prev *store.UserMeta) {
+	var err error
+	if prev == nil {
+		err = s.store.DeleteUserMeta(username)
+	} else {
+		err = s.store.SetUserMeta(username, prev)
+	}
+	if err != nil {
+		log.Printf("[admin] restore metadata of %s: %v", username, err)
+	}
+}
+
+// DeleteUser removes a user from the users file and drops their metadata,
+// sessions, reset links and codes. actor may not delete their own account.
+func (s *AdminService) DeleteUser(actor, username string) error {
+	u, ok, err := s.users.Find(username)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("not found")
+	}
+	if u.Username == actor {
+		return errors.New("cannot delete your own account")
+	}
+	if err := s.users.Delete(u.Username); err != nil {
+		return err
+	}
+	if err := s.store.DeleteUserMeta(u.Username); err != nil {
+		return err
+	}
+	if err := s.store.DeleteUserTokens(u.Username); err != nil {
+		return err
+	}
+	s.reload.Request()
+	log.Printf("[admin] deleted user %s", u.Username)
+	return nil
+}
+
+// ForcePasswordReset replaces the password of a user with a random one
+// nobody knows, ends their sessions and sends them a reset link, so the
+// only way back in is choosing a new password. actor may not reset their
+// own account this way.
+func (s *AdminService) ForcePasswordReset(actor, username string) error {
+	u, ok, err := s.users.Find(username)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("not found")
+	}
+	if u.Username == actor {
+		return errors.New("cannot force a password reset of your own account")
+	}
+	password, err := generatePassword(generatedPasswordLength)
+	if err != nil {
+		return err
+	}
+	hash, err := HashPassword(password)
+	if err != nil {
+		return err
+	}
+	u.Password = hash
+	if err := s.users.Upsert(u); err != nil {
+		return err
+	}
+	if err := s.store.DeleteUserSessions(u.Username); err != nil {
+		return err
+	}
+	s.reload.Request()
+	syncPasswordTargets(s.passwordTargets, u.Username, password, hash)
+	log.Printf("[admin] forced a password reset for %s", u.Username)
+	if err := s.account.SendPasswordReset(u.Username); err != nil {
+		return fmt.Errorf("password invalidated, but sending the reset link failed: %w", err)
+	}
+	return nil
+}
+
+// ResetTotp clears the TOTP secret of a user so they can enroll again.
+func (s *AdminService) ResetTotp(username string) error {
+	u, ok, err := s.users.Find(username)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("not found")
+	}
+	if strings.TrimSpace(u.TotpSecret) == "" {
+		return setRecoveryCodes(s.store, u.Username, nil)
+	}
+	u.TotpSecret = ""
+	if err := s.users.Upsert(u); err != nil {
+		return err
+	}
+	if err := setRecoveryCodes(s.store, u.Username, nil); err != nil {
+		return err
+	}
+	s.reload.Request()
+	log.Printf("[admin] reset TOTP of %s", u.Username)
+	return nil
+}
+
+// ImportUsers creates users in bulk with one users file write and one
+// tinyauth reload. Existing users are skipped unless overwrite is set.
+func (s *AdminService) ImportUsers(rows []ImportUser, overwrite bool) ([]ImportResult, error) {
+	existing, err := s.users.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	known := make(map[string]UserRecord, len(existing))
+	for _, u := range existing {
+		known[strings.ToLower(u.Username)] = u
+	}
+
+	type plain struct{ username, password, hash string }
+	var (
+		results []ImportResult
+		records []UserRecord
+		metas   = make(map[string]*store.UserMeta)
+		created = make(map[string]bool)
+		synced  []plain
+		seen    = make(map[string]bool)
+		phones  = make(map[string]bool)
+	)
+	for _, row := range rows {
+		res := ImportResult{Username: row.Username}
+		name, nameErr := s.names.Normalize(row.Username)
+		row.Username = name
+		key := strings.ToLower(row.Username)
+		rec, exists := known[key]
+		if exists {
+			row.Username = rec.Username
+		}
+		phone, phoneErr := s.phones.Normalize(row.Phone)
+		if phoneErr == nil {
+			row.Phone = phone
+			phoneErr = checkPhoneFree(s.store, row.Username, phone)
+		}
+		switch {
+		case nameErr != nil:
+			res.Status, res.Error = "error", nameErr.Error()
+		case seen[key]:
+			res.Status, res.Error = "error", "duplicate username in import"
+		case !validRole(row.Role):
+			res.Status, res.Error = "error", "invalid role"
+		case !validEmail(row.Email):
+			res.Status, res.Error = "error", "invalid email address"
+		case phoneErr != nil:
+			res.Status, res.Error = "error", phoneErr.Error()
+		case row.Phone != "" && phones[row.Phone]:
+			res.Status, res.Error = "error", "duplicate phone number in import"
+		case exists && !overwrite:
+			res.Status = "skipped"
+		}
+		if res.Status != "" {
+			results = append(results, res)
+			continue
+		}
+		seen[key] = true
+
+		hash := row.PasswordHash
+		if row.Password != "" {
+			if hash, err = HashPassword(row.Password); err != nil {
+				return nil, err
+			}
+			synced = append(synced, plain{row.Username, row.Password, hash})
+		} else if !strings.HasPrefix(hash, "$2") {
+			results = append(results, ImportResult{Username: row.Username, Status: "error", Error: "password or bcrypt passwordHash required"})
+			continue
+		}
+		// An existing user keeps their TOTP secret and any metadata the
+		// row does not carry.
+		if !exists {
+			rec = UserRecord{Username: row.Username}
+		}
+		rec.Password = hash
+		records = append(records, rec)
+		if row.Phone != "" {
+			phones[row.Phone] = true
+		}
+		if !exists {
+			metas[row.Username] = importMeta(nil, row)
+			created[row.Username] = true
+		} else if row.Name != "" || row.Role != "" || row.Phone != "" || row.Email != "" {
+			metas[row.Username] = importMeta(s.store.GetUserMeta(row.Username), row)
+		}
+		res.Status = "created"
+		if exists {
+			res.Status = "updated"
+		}
+		results = append(results, res)
+	}
+
+	if len(records) == 0 {
+		return results, nil
+	}
+	if err := s.users.UpsertMany(records); err != nil {
+		return nil, err
+	}
+	for username, meta := range metas {
+		if created[username] {
+			err = newAccount(s.store, username, meta)
+		} else {
+			err = s.store.SetUserMeta(username, meta)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	s.reload.Request()
+	for _, p := range synced {
+		syncPasswordTargets(s.passwordTargets, p.username, p.password, p.hash)
+	}
+	return results, nil
+}
+
+// importMeta applies the fields set in row to meta, which may be nil for a
+// new user. Changing the phone or email drops its verification like
+// UpdateUser does.
+func importMeta(meta *store.UserMeta, row ImportUser) *store.UserMeta {
+	if meta == nil {
+		meta = &store.UserMeta{}
+	}
+	meta.Approved = true
+	if row.Name != "" {
+		meta.Name = row.Name
+	}
+	if row.Role != "" {
+		meta.Role = row.Role
+	}
+	if row.Phone != "" && row.Phone != meta.Phone {
+		meta.Phone, meta.PhoneVerifiedAt = row.Phone, 0
+		clearPendingPhone(meta)
+	}
+	if email, _ := normalizeEmail(row.Email); email != "" && !strings.EqualFold(email, meta.Email) {
+		meta.Email, meta.EmailVerifiedAt = email, 0
+	}
+	return meta
+}
+
+// DiagnoseUsersFile reports problems in the users file.
+func (s *AdminService) DiagnoseUsersFile() (UsersFileDiagnosis, error) {
+	return s.users.Diagnose(s.names)
+}
+
+// RepairUsersFile fixes the users file as confirmed by the admin through
+// the checksum of a previous diagnosis, and reloads tinyauth if anything
+// changed.
+func (s *AdminService) RepairUsersFile(checksum string) (UsersFileDiagnosis, error) {
+	if checksum == "" {
+		return UsersFileDiagnosis{}, errors.New("checksum from the diagnosis required")
+	}
+	d, changed, err := s.users.Repair(checksum, s.names)
+	if err != nil {
+		return UsersFileDiagnosis{}, err
+	}
+	if changed {
+		s.reload.Request()
+	}
+	return d, nil
+}
+
+func (s *AdminService) ReloadStatus() ReloadStatus {
+	return s.reload.Status()
+}
+
+// RequestReload schedules a tinyauth reload without changing any user.
+func (s *AdminService) RequestReload() {
+	s.reload.Request()
+}
+
+// SMSStatus reports whether SMS is configured and the health of each
+// provider in failover order.
+func (s *AdminService) SMSStatus() (bool, []provider.SMSProviderStatus) {
+	return s.account.SMSEnabled(), s.account.SMSStatus()
+}
+
+func (s *AdminService) PendingSignups() ([]store.PendingSignup, error) {
+	return s.account.PendingSignups()
+}
+
+func (s *AdminService) ApproveSignup(id, reason string) error {
+	return s.account.ApproveSignup(id, reason)
+}
+
+func (s *AdminService) RejectSignup(id, reason string) error {
+	return s.account.RejectSignup(id, reason)
+}
+
+func (s *AdminService) toAdminUser(u UserRecord, meta store.UserMeta) AdminUser {
+	return AdminUser{
+		Username:      u.Username,
+		Name:          meta.Name,
+		Role:          store.RoleOf(&meta),
+		Phone:         meta.Phone,
+		PhoneVerified: meta.PhoneVerifiedAt > 0,
+		Email:         meta.Email,
+		EmailVerified: meta.EmailVerifiedAt > 0,
+		TotpEnabled:   strings.TrimSpace(u.TotpSecret) != "",
+	}
+}
+
+func validEmail(email string) bool {
+	_, err := normalizeEmail(email)
+	return err == nil
+}
+
+func validRole(role string) bool {
+	return role == "" || role == store.RoleUser || role == store.RoleAdmin
+}
@@ -4,43 +4,125 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"errors"
+	"strings"
 	"time"
 
 	"tinyauth-usermanagement/internal/config"
 	"tinyauth-usermanagement/internal/store"
 
+	"github.com/pquerna/otp/totp"
 	"golang.org/x/crypto/bcrypt"
 )
 
+// maxMFAAttempts is the number of wrong TOTP codes after which an MFA
+// ticket is burned and the user has to start over with their password.
+const maxMFAAttempts = 5
+
+// LoginResult is the outcome of the password step of a login. Exactly one
+// of SessionToken and MFATicket is set: users with TOTP enabled get a
+// short-lived ticket that must be redeemed through LoginTotp.
+type LoginResult struct {
+	SessionToken string
+	MFATicket    string
+}
+
 type AuthService struct {
 	cfg   config.Config
-	store *store.Store
+	store store.Store
 	users *UserFileService
 }
 
-func NewAuthService(cfg config.Config, st *store.Store, users *UserFileService) *AuthService {
+func NewAuthService(cfg config.Config, st store.Store, users *UserFileService) *AuthService {
 	return &AuthService{cfg: cfg, store: st, users: users}
 }
 
-func (s *AuthService) Login(username, password string) (string, error) {
+func (s *AuthService) Login(username, password string) (LoginResult, error) {
 	u, ok, err := s.users.Find(username)
 	if err != nil {
-		return "", err
+		return LoginResult{}, err
 	}
 	if !ok {
-		return "", errors.New("invalid credentials")
+		return LoginResult{}, errors.New("invalid credentials")
 	}
 	if bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password)) != nil {
-		return "", errors.New("invalid credentials")
+		return LoginResult{}, errors.New("invalid credentials")
+	}
+
+	if strings.TrimSpace(u.TotpSecret) != "" {
+		ticket, err := randomToken(32)
+		if err != nil {
+			return LoginResult{}, err
+		}
+		expires := time.Now().Unix() + s.cfg.MFATicketTTLSeconds
+		if err := s.store.CreateMFATicket(ticket, u.Username, expires); err != nil {
+			return LoginResult{}, err
+		}
+		return LoginResult{MFATicket: ticket}, nil
+	}
+
+	token, err := s.createSession(u.Username)
+	if err != nil {
+		return LoginResult{}, err
+	}
+	return LoginResult{SessionToken: token}, nil
+}
+
+// LoginTotp redeems an MFA ticket from Login with a TOTP code and returns
+// a session token.
+func (s *AuthService) LoginTotp(ticket, code string) (string, error) {
+	return s.redeemTicket(ticket, func(u UserRecord) (bool, error) {
+		return totp.Validate(strings.TrimSpace(code), strings.TrimSpace(u.TotpSecret)), nil
+	})
+}
+
+// LoginRecovery redeems an MFA ticket with a one-time recovery code, for
+// users who lost their authenticator. The code is consumed.
+func (s *AuthService) LoginRecovery(ticket, recoveryCode string) (string, error) {
+	return s.redeemTicket(ticket, func(u UserRecord) (bool, error) {
+		return consumeRecoveryCode(s.store, u.Username, recoveryCode)
+	})
+}
+
+func (s *AuthService) redeemTicket(ticket string, verify func(u UserRecord) (bool, error)) (string, error) {
+	// The attempt is counted before the code is checked, so parallel
+	// guesses on one ticket cannot get past maxMFAAttempts.
+	username, err := s.store.UseMFATicket(ticket, maxMFAAttempts, time.Now().Unix())
+	if err != nil {
+		return "", err
+	}
+	if username == "" {
+		_ = s.store.DeleteMFATicket(ticket)
+		return "", errors.New("invalid or expired ticket")
+	}
+
+	u, ok, err := s.users.Find(username)
+	if err != nil {
+		return "", err
+	}
+	if !ok || strings.TrimSpace(u.TotpSecret) == "" {
+		_ = s.store.DeleteMFATicket(ticket)
+		return "", errors.New("invalid ticket")
+	}
+	valid, err := verify(u)
+	if err != nil {
+		return "", err
+	}
+	if !valid {
+		return "", errors.New("invalid code")
 	}
 
+	_ = s.store.DeleteMFATicket(ticket)
+	return s.createSession(u.Username)
+}
+
+func (s *AuthService) createSession(username string) (string, error) {
 	token, err := randomToken(32)
 	if err != nil {
 		return "", err
 	}
 	now := time.Now().Unix()
 	expires := now + s.cfg.SessionTTLSeconds
-	if err := s.store.CreateSession(token, u.Username, now, expires); err != nil {
+	if err := s.store.CreateSession(token, username, now, expires); err != nil {
 		return "", err
 	}
 	return token, nil
@@ -0,0 +1,420 @@
+package service
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"tinyauth-usermanagement/internal/config"
+	"tinyauth-usermanagement/internal/store"
+
+	"github.com/BurntSushi/toml"
+	"golang.org/x/crypto/scrypt"
+)
+
+// backupFormat is the archive layout version written to the manifest.
+const backupFormat = 1
+
+// Files inside a backup archive.
+const (
+	backupManifestFile = "manifest.json"
+	backupUsersFile    = "users.txt"
+	backupMetaFile     = "users.toml"
+	backupStateFile    = "state.db"
+)
+
+// maxBackupFileSize bounds every file read from an archive.
+const maxBackupFileSize = 256 << 20
+
+// Encrypted archives start with backupMagic, then the scrypt salt and the
+// AES-GCM nonce, then the sealed tar.gz.
+var backupMagic = []byte("TAUMENC1")
+
+const (
+	backupSaltSize = 16
+	backupKeySize  = 32
+)
+
+// BackupFile is a manifest entry.
+type BackupFile struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// BackupManifest describes a backup archive.
+type BackupManifest struct {
+	Format       int          `json:"format"`
+	CreatedAt    int64        `json:"createdAt"`
+	StoreBackend string       `json:"storeBackend"`
+	Users        int          `json:"users"`
+	Encrypted    bool         `json:"encrypted"`
+	Files        []BackupFile `json:"files"`
+}
+
+// BackupService exports and imports the users file, user metadata and,
+// where the store has one, the state database as a single archive.
+type BackupService struct {
+	cfg   config.Config
+	store store.Store
+	users *UserFileService
+}
+
+func NewBackupService(cfg config.Config, st store.Store, users *UserFileService) *BackupService {
+	return &BackupService{cfg: cfg, store: st, users: users}
+}
+
+// Create writes a tar.gz archive to w, sealed with passphrase if it is
+// not empty.
+func (s *BackupService) Create(w io.Writer, passphrase string) (BackupManifest, error) {
+	files := map[string][]byte{}
+
+	usersData, err := s.users.Snapshot()
+	if err != nil {
+		return BackupManifest{}, fmt.Errorf("read users file: %w", err)
+	}
+	files[backupUsersFile] = usersData
+
+	if files[backupMetaFile], err = encodeMeta(s.store.ListUserMeta()); err != nil {
+		return BackupManifest{}, fmt.Errorf("encode metadata: %w", err)
+	}
+
+	if b, ok := s.store.(store.StateBackuper); ok {
+		tmp, err := os.MkdirTemp("", "um-backup-")
+		if err != nil {
+			return BackupManifest{}, err
+		}
+		defer os.RemoveAll(tmp)
+		path := filepath.Join(tmp, backupStateFile)
+		if err := b.BackupState(path); err != nil {
+			return BackupManifest{}, fmt.Errorf("back up state database: %w", err)
+		}
+		if files[backupStateFile], err = os.ReadFile(path); err != nil {
+			return BackupManifest{}, err
+		}
+	}
+
+	m := BackupManifest{
+		Format:       backupFormat,
+		CreatedAt:    time.Now().Unix(),
+		StoreBackend: s.cfg.StoreBackend,
+		Encrypted:    passphrase != "",
+	}
+	if f, err := parseUsersFile(bytes.NewReader(usersData)); err == nil {
+		m.Users = len(recordIndex(f.records()))
+	}
+	names := make([]string, 0, len(files))
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sum := sha256.Sum256(files[name])
+		m.Files = append(m.Files, BackupFile{Name: name, Size: int64(len(files[name])), SHA256: hex.EncodeToString(sum[:])})
+	}
+
+	archive, err := writeBackupArchive(m, names, files)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	if passphrase != "" {
+		if archive, err = sealBackup(archive, passphrase); err != nil {
+			return BackupManifest{}, err
+		}
+	}
+	if _, err := w.Write(archive); err != nil {
+		return BackupManifest{}, err
+	}
+	return m, nil
+}
+
+func writeBackupArchive(m BackupManifest, names []string, files map[string][]byte) ([]byte, error) {
+	manifest, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	add := func(name string, data []byte) error {
+		hdr := &tar.Header{Name: name, Mode: 0o600, Size: int64(len(data)), ModTime: time.Unix(m.CreatedAt, 0)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		_, err := tw.Write(data)
+		return err
+	}
+	if err := add(backupManifestFile, manifest); err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		if err := add(name, files[name]); err != nil {
+			return nil, err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, err
+	}
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// backupContents is a validated archive.
+type backupContents struct {
+	manifest BackupManifest
+	users    []byte
+	meta     map[string]store.UserMeta
+	state    []byte
+}
+
+// Inspect validates an archive without changing anything and returns its
+// manifest.
+func (s *BackupService) Inspect(r io.Reader, passphrase string) (BackupManifest, error) {
+	c, err := readBackup(r, passphrase)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+	return c.manifest, nil
+}
+
+// Restore validates an archive completely, then replaces the metadata,
+// the state database and the users file with its contents. Each of them
+// is swapped in atomically; if one fails, those already replaced are put
+// back as they were. The caller is responsible for reloading tinyauth.
+func (s *BackupService) Restore(r io.Reader, passphrase string) (BackupManifest, error) {
+	c, err := readBackup(r, passphrase)
+	if err != nil {
+		return BackupManifest{}, err
+	}
+
+	var stateDB string
+	if c.state != nil {
+		if _, ok := s.store.(store.StateBackuper); ok {
+			tmp, err := os.MkdirTemp("", "um-restore-")
+			if err != nil {
+				return BackupManifest{}, err
+			}
+			defer os.RemoveAll(tmp)
+			stateDB = filepath.Join(tmp, backupStateFile)
+			if err := os.WriteFile(stateDB, c.state, 0o600); err != nil {
+				return BackupManifest{}, err
+			}
+		} else {
+			log.Printf("[backup] store backend %q keeps no state database, skipping %s", s.cfg.StoreBackend, backupStateFile)
+		}
+	}
+
+	// Keep what is there now, so a step that fails can be undone. The
+	// users file goes last and needs no copy: it is written atomically.
+	prevMeta := s.store.ListUserMeta()
+	var prevState string
+	if stateDB != "" {
+		prevState = filepath.Join(filepath.Dir(stateDB), "previous.db")
+		if err := s.store.(store.StateBackuper).BackupState(prevState); err != nil {
+			return BackupManifest{}, fmt.Errorf("back up state database: %w", err)
+		}
+	}
+
+	var undo []func() error
+	fail := func(what string, err error) (BackupManifest, error) {
+		for i := len(undo) - 1; i >= 0; i-- {
+			if uerr := undo[i](); uerr != nil {
+				log.Printf("[backup] undo failed restore: %v", uerr)
+				return BackupManifest{}, fmt.Errorf("restore %s: %w; putting back the previous data failed too, the store may be inconsistent: %v", what, err, uerr)
+			}
+		}
+		return BackupManifest{}, fmt.Errorf("restore %s: %w; nothing was changed", what, err)
+	}
+
+	if err := s.store.ReplaceUserMeta(c.meta); err != nil {
+		return fail("metadata", err)
+	}
+	undo = append(undo, func() error { return s.store.ReplaceUserMeta(prevMeta) })
+	if stateDB != "" {
+		if err := s.store.(store.StateBackuper).RestoreState(stateDB); err != nil {
+			return fail("state database", err)
+		}
+		undo = append(undo, func() error { return s.store.(store.StateBackuper).RestoreState(prevState) })
+	}
+	if err := s.users.Restore(c.users); err != nil {
+		return fail("users file", err)
+	}
+	log.Printf("[backup] restored archive from %s (%d users)", time.Unix(c.manifest.CreatedAt, 0).UTC().Format(time.RFC3339), c.manifest.Users)
+	return c.manifest, nil
+}
+
+func readBackup(r io.Reader, passphrase string) (*backupContents, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxBackupFileSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(data) > maxBackupFileSize {
+		return nil, errors.New("archive too large")
+	}
+	encrypted := bytes.HasPrefix(data, backupMagic)
+	if encrypted {
+		if passphrase == "" {
+			return nil, errors.New("archive is encrypted, passphrase required")
+		}
+		if data, err = openBackup(data, passphrase); err != nil {
+			return nil, err
+		}
+	}
+
+	files, err := readBackupArchive(data)
+	if err != nil {
+		return nil, err
+	}
+	raw, ok := files[backupManifestFile]
+	if !ok {
+		return nil, errors.New("archive has no manifest")
+	}
+	var m BackupManifest
+	if err := json.Unmarshal(raw, &m); err != nil {
+		return nil, fmt.Errorf("decode manifest: %w", err)
+	}
+	if m.Format != backupFormat {
+		return nil, fmt.Errorf("unsupported archive format %d", m.Format)
+	}
+	m.Encrypted = encrypted
+	delete(files, backupManifestFile)
+	if len(files) != len(m.Files) {
+		return nil, errors.New("archive files do not match the manifest")
+	}
+	for _, f := range m.Files {
+		data, ok := files[f.Name]
+		if !ok {
+			return nil, fmt.Errorf("archive is missing %s", f.Name)
+		}
+		sum := sha256.Sum256(data)
+		if int64(len(data)) != f.Size || hex.EncodeToString(sum[:]) != f.SHA256 {
+			return nil, fmt.Errorf("checksum mismatch for %s", f.Name)
+		}
+	}
+
+	c := &backupContents{manifest: m, users: files[backupUsersFile], state: files[backupStateFile], meta: map[string]store.UserMeta{}}
+	if c.users == nil {
+		return nil, fmt.Errorf("archive is missing %s", backupUsersFile)
+	}
+	if _, err := parseUsersFile(bytes.NewReader(c.users)); err != nil {
+		return nil, fmt.Errorf("parse %s: %w", backupUsersFile, err)
+	}
+	if meta, ok := files[backupMetaFile]; ok {
+		if _, err := toml.Decode(string(meta), &c.meta); err != nil {
+			return nil, fmt.Errorf("decode %s: %w", backupMetaFile, err)
+		}
+	}
+	return c, nil
+}
+
+func readBackupArchive(data []byte) (map[string][]byte, error) {
+	gz, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("not a backup archive: %w", err)
+	}
+	defer gz.Close()
+	tr := tar.NewReader(gz)
+	files := map[string][]byte{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("read archive: %w", err)
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			return nil, fmt.Errorf("unexpected entry %s in archive", hdr.Name)
+		}
+		switch hdr.Name {
+		case backupManifestFile, backupUsersFile, backupMetaFile, backupStateFile:
+		default:
+			return nil, fmt.Errorf("unexpected entry %s in archive", hdr.Name)
+		}
+		if _, dup := files[hdr.Name]; dup {
+			return nil, fmt.Errorf("duplicate entry %s in archive", hdr.Name)
+		}
+		b, err := io.ReadAll(io.LimitReader(tr, maxBackupFileSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("read %s: %w", hdr.Name, err)
+		}
+		if len(b) > maxBackupFileSize {
+			return nil, fmt.Errorf("%s too large", hdr.Name)
+		}
+		files[hdr.Name] = b
+	}
+	return files, nil
+}
+
+func backupKey(passphrase string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), salt, 1<<15, 8, 1, backupKeySize)
+}
+
+func sealBackup(plain []byte, passphrase string) ([]byte, error) {
+	salt := make([]byte, backupSaltSize)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	key, err := backupKey(passphrase, salt)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	out := append(append(append([]byte{}, backupMagic...), salt...), nonce...)
+	return gcm.Seal(out, nonce, plain, backupMagic), nil
+}
+
+func openBackup(sealed []byte, passphrase string) ([]byte, error) {
+	rest := sealed[len(backupMagic):]
+	if len(rest) < backupSaltSize {
+		return nil, errors.New("archive is truncated")
+	}
+	key, err := backupKey(passphrase, rest[:backupSaltSize])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	rest = rest[backupSaltSize:]
+	if len(rest) < gcm.NonceSize() {
+		return nil, errors.New("archive is truncated")
+	}
+	plain, err := gcm.Open(nil, rest[:gcm.NonceSize()], rest[gcm.NonceSize():], backupMagic)
+	if err != nil {
+		return nil, errors.New("wrong passphrase or corrupted archive")
+	}
+	return plain, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -2,11 +2,12 @@ package service
 
 import (
 	"context"
+	"fmt"
 	"log"
-	"time"
 
 	"tinyauth-usermanagement/internal/config"
 
+	"github.com/docker/docker/api/types"
 	"github.com/docker/docker/api/types/container"
 	"github.com/docker/docker/client"
 )
@@ -15,20 +16,82 @@ type DockerService struct{ cfg config.Config }
 
 func NewDockerService(cfg config.Config) *DockerService { return &DockerService{cfg: cfg} }
 
-func (s *DockerService) RestartTinyauth() {
+func (s *DockerService) client() (*client.Client, error) {
 	cli, err := client.NewClientWithOpts(
 		client.WithHost("unix://"+s.cfg.DockerSocketPath),
 		client.WithAPIVersionNegotiation(),
 	)
 	if err != nil {
-		log.Printf("docker client init failed: %v", err)
-		return
+		return nil, fmt.Errorf("docker client init failed: %w", err)
+	}
+	return cli, nil
+}
+
+func (s *DockerService) RestartTinyauth(ctx context.Context) error {
+	cli, err := s.client()
+	if err != nil {
+		return err
 	}
 	defer cli.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Second)
-	defer cancel()
 	t := 10
 	if err := cli.ContainerRestart(ctx, s.cfg.TinyauthContainerName, container.StopOptions{Timeout: &t}); err != nil {
-		log.Printf("failed to restart tinyauth container %s: %v", s.cfg.TinyauthContainerName, err)
+		return fmt.Errorf("failed to restart tinyauth container %s: %w", s.cfg.TinyauthContainerName, err)
+	}
+	return nil
+}
+
+// SignalTinyauth sends signal (e.g. "SIGHUP") to the tinyauth container.
+func (s *DockerService) SignalTinyauth(ctx context.Context, signal string) error {
+	cli, err := s.client()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	if err := cli.ContainerKill(ctx, s.cfg.TinyauthContainerName, signal); err != nil {
+		return fmt.Errorf("failed to send %s to tinyauth container %s: %w", signal, s.cfg.TinyauthContainerName, err)
+	}
+	return nil
+}
+
+// ForceUpdateService restarts the tasks of a Swarm service, the equivalent
+// of `docker service update --force`.
+func (s *DockerService) ForceUpdateService(ctx context.Context, name string) error {
+	cli, err := s.client()
+	if err != nil {
+		return err
+	}
+	defer cli.Close()
+	svc, _, err := cli.ServiceInspectWithRaw(ctx, name, types.ServiceInspectOptions{})
+	if err != nil {
+		return fmt.Errorf("inspect service %s: %w", name, err)
+	}
+	spec := svc.Spec
+	spec.TaskTemplate.ForceUpdate++
+	resp, err := cli.ServiceUpdate(ctx, svc.ID, svc.Version, spec, types.ServiceUpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("update service %s: %w", name, err)
+	}
+	// Warnings, such as an image digest that could not be looked up in a
+	// private registry, do not stop the update.
+	for _, w := range resp.Warnings {
+		log.Printf("[reload] update service %s: %s", name, w)
+	}
+	return nil
+}
+
+// TinyauthState returns the current state of the tinyauth container.
+func (s *DockerService) TinyauthState(ctx context.Context) (*types.ContainerState, error) {
+	cli, err := s.client()
+	if err != nil {
+		return nil, err
+	}
+	defer cli.Close()
+	info, err := cli.ContainerInspect(ctx, s.cfg.TinyauthContainerName)
+	if err != nil {
+		return nil, fmt.Errorf("inspect tinyauth container %s: %w", s.cfg.TinyauthContainerName, err)
+	}
+	if info.ContainerJSONBase == nil || info.State == nil {
+		return nil, fmt.Errorf("inspect tinyauth container %s: no state", s.cfg.TinyauthContainerName)
 	}
+	return info.State, nil
 }
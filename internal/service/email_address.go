@@ -0,0 +1,20 @@
+package service
+
+import (
+	"net/mail"
+	"strings"
+)
+
+// normalizeEmail trims email and checks that it is a bare address, so it
+// can be used as a mail recipient. An empty address is returned as is.
+func normalizeEmail(email string) (string, error) {
+	email = strings.TrimSpace(email)
+	if email == "" {
+		return "", nil
+	}
+	addr, err := mail.ParseAddress(email)
+	if err != nil || addr.Address != email {
+		return "", &ValidationError{Field: "email", Code: ValidationInvalidEmail, Message: "invalid email address"}
+	}
+	return email, nil
+}
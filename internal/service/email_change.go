@@ -0,0 +1,177 @@
+package service
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"tinyauth-usermanagement/internal/store"
+)
+
+// emailChangeID identifies one email change request in its tokens, so that
+// links of an earlier or cancelled request stop working.
+func emailChangeID(username, email string, requestedAt int64) string {
+	return username + "\n" + email + "\n" + strconv.FormatInt(requestedAt, 10)
+}
+
+// RequestEmailChange records email as the pending address of username and
+// mails it a confirmation link. The current address, if any, gets a notice
+// with a link that cancels the change. The stored address only changes
+// once the confirmation link is followed, through ConfirmEmail.
+func (s *AccountService) RequestEmailChange(username, email string) error {
+	email, err := normalizeEmail(email)
+	if err != nil {
+		return err
+	}
+	if email == "" {
+		return &ValidationError{Field: "email", Code: ValidationRequired, Message: "email required"}
+	}
+	unlock := lockUserMeta(username)
+	meta := s.store.GetUserMeta(username)
+	if meta == nil {
+		meta = &store.UserMeta{}
+	}
+	if strings.EqualFold(meta.Email, email) && meta.EmailVerifiedAt > 0 {
+		unlock()
+		return errors.New("this is already your email address")
+	}
+	now := time.Now().Unix()
+	meta.PendingEmail, meta.PendingEmailAt = email, now
+	err = s.store.SetUserMeta(username, meta)
+	unlock()
+	if err != nil {
+		return err
+	}
+
+	id := emailChangeID(username, email, now)
+	exp := now + s.cfg.EmailVerifyTTLSeconds
+	if meta.Email != "" {
+		cancel := signToken(s.cfg.SessionSecret, tokenPurposeEmailCancel, id, exp)
+		if err := s.mail.SendEmailChangeNotice(meta.Email, username, email, cancel); err != nil {
+			log.Printf("[email] send change notice to %s: %v", meta.Email, err)
+			s.clearPendingEmail(username, id)
+			return errors.New("failed to notify your current email address")
+		}
+	}
+	confirm := signToken(s.cfg.SessionSecret, tokenPurposeEmail, id, exp)
+	if err := s.mail.SendEmailVerification(email, username, confirm); err != nil {
+		log.Printf("[email] send verification to %s: %v", email, err)
+		s.clearPendingEmail(username, id)
+		return errors.New("failed to send verification email")
+	}
+	log.Printf("[email] %s asked to change their email to %s", username, email)
+	return nil
+}
+
+// ConfirmEmail makes the pending address named by a token from
+// RequestEmailChange the email address of its user, and tells the old
+// address about it.
+func (s *AccountService) ConfirmEmail(token string) error {
+	username, id, err := emailChangeToken(s.cfg.SessionSecret, tokenPurposeEmail, token)
+	if err != nil {
+		return err
+	}
+	unlock := lockUserMeta(username)
+	meta, err := s.pendingEmailChange(username, id)
+	if err != nil {
+		unlock()
+		return err
+	}
+	old := meta.Email
+	meta.Email, meta.EmailVerifiedAt = meta.PendingEmail, time.Now().Unix()
+	meta.PendingEmail, meta.PendingEmailAt = "", 0
+	err = s.store.SetUserMeta(username, meta)
+	unlock()
+	if err != nil {
+		return err
+	}
+	log.Printf("[email] %s confirmed %s", username, meta.Email)
+	if old != "" && !strings.EqualFold(old, meta.Email) {
+		if err := s.mail.SendEmailChanged(old, username, meta.Email); err != nil {
+			log.Printf("[email] send change confirmation to %s: %v", old, err)
+		}
+	}
+	return nil
+}
+
+// CancelEmailChange drops the pending address named by a cancel token sent
+// to the old address. Since the change may not have been made by the owner,
+// all sessions of the user end as well.
+func (s *AccountService) CancelEmailChange(token string) error {
+	username, id, err := emailChangeToken(s.cfg.SessionSecret, tokenPurposeEmailCancel, token)
+	if err != nil {
+		return err
+	}
+	unlock := lockUserMeta(username)
+	meta, err := s.pendingEmailChange(username, id)
+	if err != nil {
+		unlock()
+		return err
+	}
+	meta.PendingEmail, meta.PendingEmailAt = "", 0
+	err = s.store.SetUserMeta(username, meta)
+	unlock()
+	if err != nil {
+		return err
+	}
+	if err := s.store.DeleteUserSessions(username); err != nil {
+		return err
+	}
+	log.Printf("[email] change of the email of %s was cancelled from the old address", username)
+	return nil
+}
+
+// CancelPendingEmail drops the pending address of username, for the user
+// changing their mind on the account page.
+func (s *AccountService) CancelPendingEmail(username string) error {
+	unlock := lockUserMeta(username)
+	defer unlock()
+
+	meta := s.store.GetUserMeta(username)
+	if meta == nil || meta.PendingEmail == "" {
+		return errors.New("no email change pending")
+	}
+	meta.PendingEmail, meta.PendingEmailAt = "", 0
+	return s.store.SetUserMeta(username, meta)
+}
+
+// emailChangeToken returns the user and the id of the change request a
+// token was issued for.
+func emailChangeToken(secret, purpose, token string) (username, id string, err error) {
+	id, err = verifyToken(secret, purpose, token, time.Now().Unix())
+	if err != nil {
+		return "", "", err
+	}
+	username, _, ok := strings.Cut(id, "\n")
+	if !ok {
+		return "", "", errInvalidLink
+	}
+	return username, id, nil
+}
+
+// pendingEmailChange returns the metadata of username if id is still its
+// pending change request. The caller holds the metadata lock of username.
+func (s *AccountService) pendingEmailChange(username, id string) (*store.UserMeta, error) {
+	meta := s.store.GetUserMeta(username)
+	if meta == nil || meta.PendingEmail == "" || id != emailChangeID(username, meta.PendingEmail, meta.PendingEmailAt) {
+		return nil, errInvalidLink
+	}
+	return meta, nil
+}
+
+// clearPendingEmail undoes a change request that could not be sent.
+func (s *AccountService) clearPendingEmail(username, id string) {
+	unlock := lockUserMeta(username)
+	defer unlock()
+
+	meta := s.store.GetUserMeta(username)
+	if meta == nil || id != emailChangeID(username, meta.PendingEmail, meta.PendingEmailAt) {
+		return
+	}
+	meta.PendingEmail, meta.PendingEmailAt = "", 0
+	if err := s.store.SetUserMeta(username, meta); err != nil {
+		log.Printf("[email] clear pending email of %s: %v", username, err)
+	}
+}
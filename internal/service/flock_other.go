@@ -0,0 +1,9 @@
+//go:build !unix
+
+package service
+
+// lockFile is a no-op where flock is not available; the in-process mutex
+// and the checksum check still apply.
+func lockFile(string) (unlock func(), err error) {
+	return func() {}, nil
+}
@@ -0,0 +1,153 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"tinyauth-usermanagement/internal/config"
+
+	"github.com/docker/docker/api/types"
+)
+
+// HealthChecker blocks until tinyauth is up again after a reload, or
+// reports why it is not.
+type HealthChecker interface {
+	WaitHealthy(ctx context.Context) error
+}
+
+// NewHealthChecker picks a checker for the configured reload strategy.
+// TINYAUTH_HEALTH_URL wins when set; otherwise the Docker strategies poll
+// the container state. Strategies without a way to check get no checker.
+func NewHealthChecker(cfg config.Config) HealthChecker {
+	if !cfg.ReloadHealthCheck {
+		return nil
+	}
+	interval := time.Duration(cfg.ReloadHealthIntervalMillis) * time.Millisecond
+	if cfg.TinyauthHealthURL != "" {
+		return &httpHealthChecker{url: cfg.TinyauthHealthURL, interval: interval}
+	}
+	switch cfg.ReloadStrategy {
+	case "", ReloadStrategyDockerRestart, ReloadStrategyDockerSignal:
+		stable := time.Duration(cfg.ReloadHealthStableSeconds) * time.Second
+		return &dockerHealthChecker{docker: NewDockerService(cfg), interval: interval, stable: stable}
+	}
+	return nil
+}
+
+// dockerHealthChecker waits for the container to be running and, when it
+// has a HEALTHCHECK, healthy, and then to stay so for stable without being
+// restarted. A tinyauth that rejects the new users file may only crash a
+// moment after it started, or after the signal of docker-signal, which
+// does not stop the container at all. A container that exits, dies,
+// restarts or reports unhealthy fails immediately.
+type dockerHealthChecker struct {
+	docker   *DockerService
+	interval time.Duration
+	stable   time.Duration
+}
+
+func (h *dockerHealthChecker) WaitHealthy(ctx context.Context) error {
+	var (
+		startedAt string
+		since     time.Time
+	)
+	return poll(ctx, h.interval, func() (bool, error) {
+		st, err := h.docker.TinyauthState(ctx)
+		if err != nil {
+			return false, nil // the daemon may be busy with the restart
+		}
+		if startedAt != "" && st.StartedAt != startedAt {
+			return false, errors.New("tinyauth container restarted during the health check")
+		}
+		ok, err := containerHealthy(st)
+		if err != nil || !ok {
+			return false, err
+		}
+		if startedAt == "" {
+			startedAt, since = st.StartedAt, time.Now()
+		}
+		return time.Since(since) >= h.stable, nil
+	})
+}
+
+func containerHealthy(st *types.ContainerState) (bool, error) {
+	switch {
+	case st.Dead, st.Status == "exited", st.Status == "dead":
+		msg := fmt.Sprintf("tinyauth container %s (exit code %d)", st.Status, st.ExitCode)
+		if st.Error != "" {
+			msg += ": " + st.Error
+		}
+		return false, errors.New(msg)
+	case st.Restarting || !st.Running:
+		return false, nil
+	case st.Health == nil:
+		return true, nil
+	}
+	switch st.Health.Status {
+	case types.Healthy:
+		return true, nil
+	case types.Unhealthy:
+		msg := "tinyauth container unhealthy"
+		if n := len(st.Health.Log); n > 0 && st.Health.Log[n-1] != nil {
+			msg += ": " + strings.TrimSpace(st.Health.Log[n-1].Output)
+		}
+		return false, errors.New(msg)
+	}
+	return false, nil
+}
+
+// httpHealthChecker waits for a 2xx response from tinyauth.
+type httpHealthChecker struct {
+	url      string
+	interval time.Duration
+}
+
+func (h *httpHealthChecker) WaitHealthy(ctx context.Context) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+	var last error
+	err := poll(ctx, h.interval, func() (bool, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, h.url, nil)
+		if err != nil {
+			return false, err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			last = err
+			return false, nil
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			last = fmt.Errorf("%s returned %d", h.url, resp.StatusCode)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err != nil && last != nil && errors.Is(err, context.DeadlineExceeded) {
+		return fmt.Errorf("%w: %v", err, last)
+	}
+	return err
+}
+
+// poll calls check every interval until it reports done, fails, or ctx ends.
+func poll(ctx context.Context, interval time.Duration, check func() (bool, error)) error {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("tinyauth did not become healthy: %w", ctx.Err())
+		case <-t.C:
+		}
+		ok, err := check()
+		if err != nil {
+			return err
+		}
+		if ok {
+			return nil
+		}
+	}
+}
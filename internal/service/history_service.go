@@ -0,0 +1,505 @@
+package service
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tinyauth-usermanagement/internal/config"
+	"tinyauth-usermanagement/internal/store"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Files kept in every history version.
+const (
+	historyUsersFile = "users.txt"
+	historyMetaFile  = "users.toml"
+	historyInfoFile  = "version.json"
+)
+
+// historyIDFormat sorts lexically in time order.
+const historyIDFormat = "20060102T150405.000000000Z"
+
+// HistoryVersion describes one saved state of the users file and metadata.
+type HistoryVersion struct {
+	ID        string `json:"id"`
+	CreatedAt int64  `json:"createdAt"`
+	Users     int    `json:"users"`
+	Note      string `json:"note,omitempty"`
+}
+
+// User diff change kinds. Hashes and secrets are never part of a diff.
+const (
+	DiffAdded        = "added"
+	DiffRemoved      = "removed"
+	DiffPassword     = "password"
+	DiffTotpEnabled  = "totp_enabled"
+	DiffTotpDisabled = "totp_disabled"
+	DiffTotpChanged  = "totp_changed"
+	DiffName         = "name"
+	DiffRole         = "role"
+	DiffPhone        = "phone"
+	DiffEmail        = "email"
+)
+
+// UserDiff lists what changed for one user between two versions.
+type UserDiff struct {
+	Username string   `json:"username"`
+	Changes  []string `json:"changes"`
+}
+
+// HistoryCurrent names the live state in diffs.
+const HistoryCurrent = "current"
+
+// HistoryService keeps a rotated snapshot of users.txt and the user
+// metadata (exported as users.toml) after every write of the users file
+// and every metadata write that changes what a diff shows, and can diff
+// and roll back to them.
+type HistoryService struct {
+	cfg    config.Config
+	store  store.Store
+	users  *UserFileService
+	reload *ReloadService
+	dir    string
+	// metaWritten wakes watchMeta after metadata writes.
+	metaWritten chan struct{}
+
+	mu     sync.Mutex
+	paused bool // set by Rollback, which records a single version at the end
+	// shown is what a diff shows of the metadata in the latest version.
+	shown map[string]shownMeta
+
+	rollbackMu sync.Mutex
+}
+
+func NewHistoryService(cfg config.Config, st store.Store, users *UserFileService, reload *ReloadService) *HistoryService {
+	dir := cfg.UsersHistoryDir
+	if dir == "" {
+		dir = filepath.Join(filepath.Dir(cfg.UsersFilePath), ".history")
+	}
+	return &HistoryService{cfg: cfg, store: st, users: users, reload: reload, dir: dir, metaWritten: make(chan struct{}, 1)}
+}
+
+// Enabled reports whether any versions are kept.
+func (h *HistoryService) Enabled() bool { return h.cfg.UsersHistoryRetention > 0 }
+
+// Start records the current state if it differs from the latest version
+// and hooks into users file and metadata writes.
+func (h *HistoryService) Start() {
+	if !h.Enabled() {
+		return
+	}
+	if data, err := h.users.Snapshot(); err != nil {
+		log.Printf("[history] snapshot users file: %v", err)
+	} else {
+		h.recordNote(data, "startup")
+	}
+	h.users.OnWrite(h.record)
+	h.store.OnUserMetaWrite(func() {
+		select {
+		case h.metaWritten <- struct{}{}:
+		default: // watchMeta has yet to pick up an earlier write
+		}
+	})
+	go h.watchMeta()
+}
+
+func (h *HistoryService) record(data []byte) {
+	h.recordNote(data, "")
+}
+
+// watchMeta records a version, with the users file as it is now, after
+// metadata writes that change a name, role, phone or email. Most writes
+// only touch codes, attempt counters or timestamps; recording those would
+// push real changes out of the retention. It runs in the background so
+// that writers do not wait for the comparison.
+func (h *HistoryService) watchMeta() {
+	for range h.metaWritten {
+		shown := shownMetaOf(h.store.ListUserMeta())
+		h.mu.Lock()
+		same := h.paused || shownMetaEqual(h.shown, shown)
+		h.mu.Unlock()
+		if same {
+			continue
+		}
+		data, err := h.users.Snapshot()
+		if err != nil {
+			log.Printf("[history] snapshot users file: %v", err)
+			continue
+		}
+		h.recordNote(data, "")
+	}
+}
+
+// shownMeta is the part of the metadata of a user that diffs show.
+type shownMeta struct {
+	Name, Role, Phone, Email string
+}
+
+func shownMetaOf(all map[string]store.UserMeta) map[string]shownMeta {
+	res := make(map[string]shownMeta, len(all))
+	for username, m := range all {
+		if v := (shownMeta{Name: m.Name, Role: m.Role, Phone: m.Phone, Email: m.Email}); v != (shownMeta{}) {
+			res[username] = v
+		}
+	}
+	return res
+}
+
+func shownMetaEqual(a, b map[string]shownMeta) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for username, m := range a {
+		if n, ok := b[username]; !ok || n != m {
+			return false
+		}
+	}
+	return true
+}
+
+func (h *HistoryService) recordNote(data []byte, note string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.paused {
+		return
+	}
+
+	all := h.store.ListUserMeta()
+	meta, err := encodeMeta(all)
+	if err != nil {
+		log.Printf("[history] encode metadata: %v", err)
+		return
+	}
+	h.shown = shownMetaOf(all)
+	if latest, err := h.latestNoLock(); err == nil && latest != "" {
+		prevUsers, _ := os.ReadFile(filepath.Join(h.dir, latest, historyUsersFile))
+		prevMeta, _ := os.ReadFile(filepath.Join(h.dir, latest, historyMetaFile))
+		if bytes.Equal(prevUsers, data) && bytes.Equal(prevMeta, meta) {
+			return
+		}
+	}
+
+	now := time.Now().UTC()
+	info := HistoryVersion{ID: now.Format(historyIDFormat), CreatedAt: now.Unix(), Note: note}
+	if f, err := parseUsersFile(bytes.NewReader(data)); err == nil {
+		info.Users = len(recordIndex(f.records()))
+	}
+	if err := h.writeVersionNoLock(info, data, meta); err != nil {
+		log.Printf("[history] save version: %v", err)
+		return
+	}
+	h.pruneNoLock()
+}
+
+func (h *HistoryService) writeVersionNoLock(info HistoryVersion, users, meta []byte) error {
+	tmp := filepath.Join(h.dir, ".tmp-"+info.ID)
+	if err := os.MkdirAll(tmp, 0o700); err != nil {
+		return err
+	}
+	infoJSON, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	for name, data := range map[string][]byte{historyUsersFile: users, historyMetaFile: meta, historyInfoFile: infoJSON} {
+		if err := os.WriteFile(filepath.Join(tmp, name), data, 0o600); err != nil {
+			os.RemoveAll(tmp)
+			return err
+		}
+	}
+	return os.Rename(tmp, filepath.Join(h.dir, info.ID))
+}
+
+// pruneNoLock removes the oldest versions beyond the retention.
+func (h *HistoryService) pruneNoLock() {
+	ids, err := h.idsNoLock()
+	if err != nil {
+		return
+	}
+	for len(ids) > h.cfg.UsersHistoryRetention {
+		if err := os.RemoveAll(filepath.Join(h.dir, ids[0])); err != nil {
+			log.Printf("[history] prune %s: %v", ids[0], err)
+			return
+		}
+		ids = ids[1:]
+	}
+}
+
+// idsNoLock returns version ids, oldest first.
+func (h *HistoryService) idsNoLock() ([]string, error) {
+	entries, err := os.ReadDir(h.dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, e := range entries {
+		if e.IsDir() && !strings.HasPrefix(e.Name(), ".") {
+			ids = append(ids, e.Name())
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+func (h *HistoryService) latestNoLock() (string, error) {
+	ids, err := h.idsNoLock()
+	if err != nil || len(ids) == 0 {
+		return "", err
+	}
+	return ids[len(ids)-1], nil
+}
+
+// List returns all kept versions, newest first.
+func (h *HistoryService) List() ([]HistoryVersion, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ids, err := h.idsNoLock()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]HistoryVersion, 0, len(ids))
+	for i := len(ids) - 1; i >= 0; i-- {
+		data, err := os.ReadFile(filepath.Join(h.dir, ids[i], historyInfoFile))
+		if err != nil {
+			continue
+		}
+		var v HistoryVersion
+		if err := json.Unmarshal(data, &v); err == nil {
+			res = append(res, v)
+		}
+	}
+	return res, nil
+}
+
+// historyState is a users file and metadata pair, from a version or live.
+type historyState struct {
+	users   map[string]UserRecord
+	meta    map[string]store.UserMeta
+	raw     []byte
+	hasMeta bool
+}
+
+func (h *HistoryService) load(id string) (historyState, error) {
+	if id == HistoryCurrent {
+		raw, err := h.users.Snapshot()
+		if err != nil {
+			return historyState{}, err
+		}
+		st, err := parseState(raw, nil)
+		if err != nil {
+			return historyState{}, err
+		}
+		st.meta, st.hasMeta = h.store.ListUserMeta(), true
+		return st, nil
+	}
+	if id == "" || strings.ContainsAny(id, `/\`) || strings.HasPrefix(id, ".") {
+		return historyState{}, errors.New("invalid version")
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	dir := filepath.Join(h.dir, id)
+	raw, err := os.ReadFile(filepath.Join(dir, historyUsersFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return historyState{}, errors.New("version not found")
+	}
+	if err != nil {
+		return historyState{}, err
+	}
+	meta, err := os.ReadFile(filepath.Join(dir, historyMetaFile))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return historyState{}, err
+	}
+	return parseState(raw, meta)
+}
+
+func parseState(raw, meta []byte) (historyState, error) {
+	f, err := parseUsersFile(bytes.NewReader(raw))
+	if err != nil {
+		return historyState{}, err
+	}
+	st := historyState{users: recordIndex(f.records()), raw: raw, meta: map[string]store.UserMeta{}}
+	if meta != nil {
+		if _, err := toml.Decode(string(meta), &st.meta); err != nil {
+			return historyState{}, fmt.Errorf("decode metadata: %w", err)
+		}
+		st.hasMeta = true
+	}
+	return st, nil
+}
+
+// Diff lists per-user changes going from version from to version to.
+// Either may be HistoryCurrent.
+func (h *HistoryService) Diff(from, to string) ([]UserDiff, error) {
+	a, err := h.load(from)
+	if err != nil {
+		return nil, err
+	}
+	b, err := h.load(to)
+	if err != nil {
+		return nil, err
+	}
+	return diffStates(a, b), nil
+}
+
+func diffStates(a, b historyState) []UserDiff {
+	names := make(map[string]string)
+	for k, u := range a.users {
+		names[k] = u.Username
+	}
+	for k, u := range b.users {
+		names[k] = u.Username
+	}
+	res := []UserDiff{}
+	for key, name := range names {
+		ua, inA := a.users[key]
+		ub, inB := b.users[key]
+		var changes []string
+		switch {
+		case !inA:
+			changes = append(changes, DiffAdded)
+		case !inB:
+			changes = append(changes, DiffRemoved)
+		default:
+			if ua.Password != ub.Password {
+				changes = append(changes, DiffPassword)
+			}
+			switch {
+			case ua.TotpSecret == "" && ub.TotpSecret != "":
+				changes = append(changes, DiffTotpEnabled)
+			case ua.TotpSecret != "" && ub.TotpSecret == "":
+				changes = append(changes, DiffTotpDisabled)
+			case ua.TotpSecret != ub.TotpSecret:
+				changes = append(changes, DiffTotpChanged)
+			}
+		}
+		if a.hasMeta && b.hasMeta && inA && inB {
+			ma, mb := metaFor(a.meta, ua.Username), metaFor(b.meta, ub.Username)
+			if ma.Name != mb.Name {
+				changes = append(changes, DiffName)
+			}
+			if store.RoleOf(&ma) != store.RoleOf(&mb) {
+				changes = append(changes, DiffRole)
+			}
+			if ma.Phone != mb.Phone {
+				changes = append(changes, DiffPhone)
+			}
+			if ma.Email != mb.Email {
+				changes = append(changes, DiffEmail)
+			}
+		}
+		if len(changes) > 0 {
+			res = append(res, UserDiff{Username: name, Changes: changes})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Username < res[j].Username })
+	return res
+}
+
+// metaFor looks metadata up by exact name first, then case-insensitively.
+func metaFor(all map[string]store.UserMeta, username string) store.UserMeta {
+	if m, ok := all[username]; ok {
+		return m
+	}
+	for k, m := range all {
+		if strings.EqualFold(k, username) {
+			return m
+		}
+	}
+	return store.UserMeta{}
+}
+
+// Rollback restores the users file and metadata of version id and reloads
+// tinyauth. The restored state is recorded as a new version. Security
+// state is not rolled back; see rollbackMeta.
+func (h *HistoryService) Rollback(id string) error {
+	if id == HistoryCurrent {
+		return errors.New("invalid version")
+	}
+	h.rollbackMu.Lock()
+	defer h.rollbackMu.Unlock()
+
+	st, err := h.load(id)
+	if err != nil {
+		return err
+	}
+	h.setPaused(true)
+	err = h.restore(st)
+	h.setPaused(false)
+	note := "rollback to " + id
+	if err != nil {
+		note = "failed " + note
+	}
+	if data, serr := h.users.Snapshot(); serr != nil {
+		log.Printf("[history] snapshot users file: %v", serr)
+	} else {
+		h.recordNote(data, note)
+	}
+	if err != nil {
+		return err
+	}
+	h.reload.Request()
+	log.Printf("[history] rolled back to %s", id)
+	return nil
+}
+
+func (h *HistoryService) setPaused(paused bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.paused = paused
+}
+
+func (h *HistoryService) restore(st historyState) error {
+	if st.hasMeta {
+		current := h.store.ListUserMeta()
+		meta := make(map[string]store.UserMeta, len(st.meta))
+		for username, m := range st.meta {
+			meta[username] = rollbackMeta(m, metaFor(current, username))
+		}
+		if err := h.store.ReplaceUserMeta(meta); err != nil {
+			return fmt.Errorf("restore metadata: %w", err)
+		}
+	}
+	if err := h.users.Restore(st.raw); err != nil {
+		return fmt.Errorf("restore users file: %w", err)
+	}
+	return nil
+}
+
+// rollbackMeta returns the metadata of a version with the security state of
+// cur, the live metadata of the same user: rolling back must not revive
+// used recovery codes or old confirmation codes, nor mark an address
+// verified that the user has not confirmed.
+func rollbackMeta(m, cur store.UserMeta) store.UserMeta {
+	m.RecoveryCodes = cur.RecoveryCodes
+	m.PendingPhone, m.PendingPhoneAt = cur.PendingPhone, cur.PendingPhoneAt
+	m.PendingPhoneCode, m.PendingPhoneAttempts = cur.PendingPhoneCode, cur.PendingPhoneAttempts
+	m.PendingEmail, m.PendingEmailAt = cur.PendingEmail, cur.PendingEmailAt
+	m.PhoneVerifiedAt, m.EmailVerifiedAt = 0, 0
+	if m.Phone == cur.Phone {
+		m.PhoneVerifiedAt = cur.PhoneVerifiedAt
+	}
+	if strings.EqualFold(m.Email, cur.Email) {
+		m.EmailVerifiedAt = cur.EmailVerifiedAt
+	}
+	return m
+}
+
+func encodeMeta(all map[string]store.UserMeta) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(all); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"log"
 	"net/smtp"
+	"net/url"
 
 	"tinyauth-usermanagement/internal/config"
 
@@ -20,11 +21,79 @@ func (s *MailService) SendResetEmail(toEmail, token string) error {
 		log.Printf("[mail disabled] reset token for %s: %s (%s)", toEmail, token, resetURL)
 		return nil
 	}
+	return s.send(toEmail, "Password reset request", "Reset your password: "+resetURL)
+}
+
+// SendSignupVerification sends the link that confirms the email address
+// of a signup as username.
+func (s *MailService) SendSignupVerification(toEmail, username, token string) error {
+	verifyURL := fmt.Sprintf("%s/verify-email?token=%s", s.cfg.MailBaseURL, url.QueryEscape(token))
+	if s.cfg.SMTPHost == "" {
+		log.Printf("[mail disabled] signup verification for %s (%s): %s", toEmail, username, verifyURL)
+		return nil
+	}
+	return s.send(toEmail, "Confirm your email address",
+		fmt.Sprintf("Confirm your email address to finish signing up as %q: %s", username, verifyURL))
+}
+
+// SendEmailVerification sends the link that confirms toEmail as the new
+// address of username.
+func (s *MailService) SendEmailVerification(toEmail, username, token string) error {
+	confirmURL := fmt.Sprintf("%s/confirm-email?token=%s", s.cfg.MailBaseURL, url.QueryEscape(token))
+	if s.cfg.SMTPHost == "" {
+		log.Printf("[mail disabled] email verification for %s (%s): %s", toEmail, username, confirmURL)
+		return nil
+	}
+	return s.send(toEmail, "Confirm your new email address",
+		fmt.Sprintf("Confirm %s as the email address of %q: %s", toEmail, username, confirmURL))
+}
+
+// SendEmailChangeNotice tells the current address of username that a
+// change to newEmail was requested, with a link that cancels it.
+func (s *MailService) SendEmailChangeNotice(toEmail, username, newEmail, cancelToken string) error {
+	cancelURL := fmt.Sprintf("%s/cancel-email?token=%s", s.cfg.MailBaseURL, url.QueryEscape(cancelToken))
+	if s.cfg.SMTPHost == "" {
+		log.Printf("[mail disabled] email change notice for %s (%s -> %s): %s", toEmail, username, newEmail, cancelURL)
+		return nil
+	}
+	return s.send(toEmail, "Your email address is being changed",
+		fmt.Sprintf("Someone asked to change the email address of %q to %s. If this was not you, cancel the change and sign out everywhere: %s\n\nThen change your password.", username, newEmail, cancelURL))
+}
+
+// SendEmailChanged tells the old address of username that the change to
+// newEmail is done.
+func (s *MailService) SendEmailChanged(toEmail, username, newEmail string) error {
+	if s.cfg.SMTPHost == "" {
+		log.Printf("[mail disabled] email changed notice for %s (%s -> %s)", toEmail, username, newEmail)
+		return nil
+	}
+	return s.send(toEmail, "Your email address was changed",
+		fmt.Sprintf("The email address of %q is now %s. Password reset links will be sent there.", username, newEmail))
+}
+
+// SendSignupDecision tells an applicant whether their signup as username
+// was approved, with the admin's reason if one was given.
+func (s *MailService) SendSignupDecision(toEmail, username string, approved bool, reason string) error {
+	subject, text := "Your account request was declined", fmt.Sprintf("Your request for the account %q was declined.", username)
+	if approved {
+		subject, text = "Your account was approved", fmt.Sprintf("Your account %q was approved. You can sign in now: %s", username, s.cfg.MailBaseURL)
+	}
+	if reason != "" {
+		text += "\n\nReason: " + reason
+	}
+	if s.cfg.SMTPHost == "" {
+		log.Printf("[mail disabled] signup decision for %s (%s): %s", toEmail, username, subject)
+		return nil
+	}
+	return s.send(toEmail, subject, text)
+}
+
+func (s *MailService) send(toEmail, subject, text string) error {
 	e := email.NewEmail()
 	e.From = s.cfg.SMTPFrom
 	e.To = []string{toEmail}
-	e.Subject = "Password reset request"
-	e.Text = []byte("Reset your password: " + resetURL)
+	e.Subject = subject
+	e.Text = []byte(text)
 	addr := fmt.Sprintf("%s:%d", s.cfg.SMTPHost, s.cfg.SMTPPort)
 	auth := smtp.PlainAuth("", s.cfg.SMTPUsername, s.cfg.SMTPPassword, s.cfg.SMTPHost)
 	return e.Send(addr, auth)
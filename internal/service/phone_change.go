@@ -0,0 +1,181 @@
+package service
+
+import (
+	"crypto/hmac"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"tinyauth-usermanagement/internal/store"
+)
+
+const (
+	// phoneCodeTTL is how long a code confirming a phone number works.
+	phoneCodeTTL = 10 * time.Minute
+	// phoneCodeResendInterval is the least time between two codes for the
+	// same number, so the account page cannot be used to flood a phone.
+	phoneCodeResendInterval = time.Minute
+)
+
+// phoneCodeHash keys the hash of a confirmation code to the user and the
+// number it was sent to. With SESSION_SECRET as the key, the six digits
+// cannot be recovered from users.toml by trying all of them.
+func phoneCodeHash(secret, username, phone, code string) string {
+	return tokenMAC(secret, tokenPurposePhone, username+"\n"+phone+"\n"+strings.TrimSpace(code))
+}
+
+// RequestPhoneChange records phone as the pending number of username and
+// texts it a one-time code. The stored number only changes once that code
+// is entered, through ConfirmPhone. An empty phone removes the number right
+// away. Numbers are stored in E.164 form.
+//
+// Whether another user has the number is only checked once the code proves
+// the number is this user's, so asking tells nothing about who is
+// registered. Without an SMS provider numbers cannot be confirmed, so phone
+// is stored right away and stays unverified. pending reports whether a
+// code was sent.
+func (s *AccountService) RequestPhoneChange(username, phone string) (pending bool, err error) {
+	if phone, err = s.phones.Normalize(phone); err != nil {
+		return false, err
+	}
+	unlock := lockUserMeta(username)
+	defer unlock()
+
+	meta := s.store.GetUserMeta(username)
+	if meta == nil {
+		meta = &store.UserMeta{}
+	}
+	if phone == "" || s.sms == nil {
+		if phone != meta.Phone {
+			meta.Phone, meta.PhoneVerifiedAt = phone, 0
+		}
+		clearPendingPhone(meta)
+		return false, phoneTaken(s.store.SetUserMeta(username, meta))
+	}
+	if phone == meta.Phone && meta.PhoneVerifiedAt > 0 {
+		return false, errors.New("this is already your phone number")
+	}
+	now := time.Now()
+	if phone == meta.PendingPhone && now.Before(time.Unix(meta.PendingPhoneAt, 0).Add(phoneCodeResendInterval)) {
+		return false, errors.New("a code was just sent to this number, wait a minute before asking for another")
+	}
+	code, err := generateNumericCode(6)
+	if err != nil {
+		return false, err
+	}
+	meta.PendingPhone, meta.PendingPhoneAt = phone, now.Unix()
+	meta.PendingPhoneCode = phoneCodeHash(s.cfg.SessionSecret, username, phone, code)
+	meta.PendingPhoneAttempts = 0
+	if err := s.store.SetUserMeta(username, meta); err != nil {
+		return false, err
+	}
+
+	msg := fmt.Sprintf("Your phone number confirmation code is: %s (valid for %d minutes)", code, int(phoneCodeTTL.Minutes()))
+	if err := s.sendSMS(phone, msg); err != nil {
+		clearPendingPhone(meta)
+		if err := s.store.SetUserMeta(username, meta); err != nil {
+			log.Printf("[sms] clear pending phone of %s: %v", username, err)
+		}
+		return false, err
+	}
+	log.Printf("[sms] %s asked to change their phone number to %s", username, phone)
+	return true, nil
+}
+
+// ConfirmPhone makes the pending number of username its phone number if
+// code is the one sent to it. After SMS_CODE_MAX_ATTEMPTS wrong codes, or
+// once the code expired, the pending number is dropped.
+func (s *AccountService) ConfirmPhone(username, code string) error {
+	unlock := lockUserMeta(username)
+	defer unlock()
+
+	meta := s.store.GetUserMeta(username)
+	if meta == nil || meta.PendingPhone == "" {
+		return errors.New("no phone change pending")
+	}
+	now := time.Now()
+	if now.After(time.Unix(meta.PendingPhoneAt, 0).Add(phoneCodeTTL)) {
+		clearPendingPhone(meta)
+		if err := s.store.SetUserMeta(username, meta); err != nil {
+			return err
+		}
+		return errors.New("code expired, request a new one")
+	}
+	want := phoneCodeHash(s.cfg.SessionSecret, username, meta.PendingPhone, code)
+	if !hmac.Equal([]byte(want), []byte(meta.PendingPhoneCode)) {
+		meta.PendingPhoneAttempts++
+		if meta.PendingPhoneAttempts >= s.cfg.SMSCodeMaxAttempts {
+			clearPendingPhone(meta)
+			if err := s.store.SetUserMeta(username, meta); err != nil {
+				return err
+			}
+			return errors.New("too many invalid codes, request a new one")
+		}
+		if err := s.store.SetUserMeta(username, meta); err != nil {
+			return err
+		}
+		return errors.New("invalid code")
+	}
+
+	phone := meta.PendingPhone
+	clearPendingPhone(meta)
+	confirmed := *meta
+	confirmed.Phone, confirmed.PhoneVerifiedAt = phone, now.Unix()
+	if err := s.store.SetUserMeta(username, &confirmed); err != nil {
+		// Someone else confirmed the number first; the code is used up
+		// either way.
+		if errors.Is(err, store.ErrPhoneTaken) {
+			if err := s.store.SetUserMeta(username, meta); err != nil {
+				log.Printf("[sms] clear pending phone of %s: %v", username, err)
+			}
+		}
+		return phoneTaken(err)
+	}
+	log.Printf("[sms] %s confirmed phone number %s", username, phone)
+	return nil
+}
+
+// CancelPendingPhone drops the pending number of username.
+func (s *AccountService) CancelPendingPhone(username string) error {
+	unlock := lockUserMeta(username)
+	defer unlock()
+
+	meta := s.store.GetUserMeta(username)
+	if meta == nil || meta.PendingPhone == "" {
+		return errors.New("no phone change pending")
+	}
+	clearPendingPhone(meta)
+	return s.store.SetUserMeta(username, meta)
+}
+
+// NormalizePhone returns phone in the form it is stored in, for callers
+// that key anything else on numbers.
+func (s *AccountService) NormalizePhone(phone string) (string, error) {
+	return s.phones.Normalize(phone)
+}
+
+// verifiedPhoneUser returns the user whose confirmed number is phone, or ""
+// if there is none. Numbers that were never confirmed are not trusted for
+// SMS password resets.
+func (s *AccountService) verifiedPhoneUser(phone string) (string, error) {
+	phone, err := s.phones.Normalize(phone)
+	if err != nil {
+		return "", err
+	}
+	username, err := s.store.FindUserByPhone(phone)
+	if err != nil || username == "" {
+		return "", err
+	}
+	meta := s.store.GetUserMeta(username)
+	if meta == nil || meta.Phone != phone || meta.PhoneVerifiedAt == 0 {
+		return "", nil
+	}
+	return username, nil
+}
+
+func clearPendingPhone(meta *store.UserMeta) {
+	meta.PendingPhone, meta.PendingPhoneAt = "", 0
+	meta.PendingPhoneCode, meta.PendingPhoneAttempts = "", 0
+}
@@ -0,0 +1,237 @@
+package service
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"tinyauth-usermanagement/internal/config"
+	"tinyauth-usermanagement/internal/store"
+)
+
+// phoneRegion describes how numbers are dialled within a region: its
+// country calling code, the trunk prefix national numbers start with and
+// the prefix for dialling abroad.
+type phoneRegion struct {
+	code, trunk, intl string
+}
+
+// phoneRegions are the regions PHONE_DEFAULT_REGION may name. Numbers from
+// elsewhere can always be given in international form.
+var phoneRegions = map[string]phoneRegion{
+	"AE": {"971", "0", "00"},
+	"AT": {"43", "0", "00"},
+	"AU": {"61", "0", "0011"},
+	"BE": {"32", "0", "00"},
+	"BG": {"359", "0", "00"},
+	"CA": {"1", "1", "011"},
+	"CH": {"41", "0", "00"},
+	"CN": {"86", "0", "00"},
+	"CY": {"357", "", "00"},
+	"CZ": {"420", "", "00"},
+	"DE": {"49", "0", "00"},
+	"DK": {"45", "", "00"},
+	"EE": {"372", "", "00"},
+	"ES": {"34", "", "00"},
+	"FI": {"358", "0", "00"},
+	"FR": {"33", "0", "00"},
+	"GB": {"44", "0", "00"},
+	"GR": {"30", "", "00"},
+	"HK": {"852", "", "001"},
+	"HR": {"385", "0", "00"},
+	"HU": {"36", "06", "00"},
+	"IE": {"353", "0", "00"},
+	"IL": {"972", "0", "00"},
+	"IN": {"91", "0", "00"},
+	"IS": {"354", "", "00"},
+	"IT": {"39", "", "00"},
+	"JP": {"81", "0", "010"},
+	"KR": {"82", "0", "001"},
+	"LU": {"352", "", "00"},
+	"LV": {"371", "", "00"},
+	"MT": {"356", "", "00"},
+	"MX": {"52", "", "00"},
+	"NL": {"31", "0", "00"},
+	"NO": {"47", "", "00"},
+	"NZ": {"64", "0", "00"},
+	"PL": {"48", "", "00"},
+	"PT": {"351", "", "00"},
+	"RO": {"40", "0", "00"},
+	"SE": {"46", "0", "00"},
+	"SG": {"65", "", "000"},
+	"SI": {"386", "0", "00"},
+	"SK": {"421", "0", "00"},
+	"TR": {"90", "0", "00"},
+	"UA": {"380", "0", "00"},
+	"US": {"1", "1", "011"},
+	"ZA": {"27", "0", "00"},
+}
+
+// PhonePolicy turns phone numbers as people type them into E.164
+// ("+31612345678"), so each number has one spelling in the metadata.
+type PhonePolicy struct {
+	// Region is the ISO 3166 code numbers without a country code are
+	// read in. Empty means such numbers are rejected.
+	Region string
+}
+
+// NewPhonePolicy builds the policy from PHONE_DEFAULT_REGION.
+func NewPhonePolicy(cfg config.Config) PhonePolicy {
+	return PhonePolicy{Region: strings.ToUpper(strings.TrimSpace(cfg.PhoneDefaultRegion))}
+}
+
+// CheckRegion reports an error if Region is not one the policy knows.
+func (p PhonePolicy) CheckRegion() error {
+	if _, ok := phoneRegions[p.Region]; p.Region != "" && !ok {
+		return fmt.Errorf("unknown phone region %q", p.Region)
+	}
+	return nil
+}
+
+// Normalize returns phone in E.164 form. Spaces, dashes, dots, slashes and
+// parentheses are ignored; numbers may start with "+", the international
+// prefix of the default region (or "00" without one), or otherwise are
+// national numbers of the default region. An empty phone is returned as
+// is.
+func (p PhonePolicy) Normalize(phone string) (string, error) {
+	phone = strings.TrimSpace(phone)
+	if phone == "" {
+		return "", nil
+	}
+	var b strings.Builder
+	plus := false
+	for i, r := range phone {
+		switch {
+		case r >= '0' && r <= '9':
+			b.WriteRune(r)
+		case r == '+' && i == 0:
+			plus = true
+		case strings.ContainsRune(" -./()", r):
+		default:
+			return "", phoneError("phone number contains invalid character %q", r)
+		}
+	}
+	digits := b.String()
+
+	region, ok := phoneRegions[p.Region]
+	switch {
+	case plus:
+	case ok && strings.HasPrefix(digits, region.intl):
+		digits = digits[len(region.intl):]
+	case !ok && strings.HasPrefix(digits, "00"):
+		digits = digits[2:]
+	case ok:
+		if region.trunk != "" {
+			digits = strings.TrimPrefix(digits, region.trunk)
+		}
+		digits = region.code + digits
+	default:
+		return "", phoneError("phone number needs a country code, like +31 6 12345678")
+	}
+	// E.164 numbers have at most 15 digits and country codes never start
+	// with 0. The shortest numbers in use have 7.
+	if len(digits) < 7 || len(digits) > 15 || digits[0] == '0' {
+		return "", phoneError("invalid phone number")
+	}
+	return "+" + digits, nil
+}
+
+func phoneError(format string, args ...any) error {
+	return &ValidationError{Field: "phone", Code: ValidationInvalidPhone, Message: fmt.Sprintf(format, args...)}
+}
+
+// phoneTaken turns store.ErrPhoneTaken into an error clients can map to
+// the phone field.
+func phoneTaken(err error) error {
+	if errors.Is(err, store.ErrPhoneTaken) {
+		return &ValidationError{Field: "phone", Code: ValidationPhoneTaken, Message: err.Error()}
+	}
+	return err
+}
+
+// checkPhoneFree fails if phone is already the verified number of a user
+// other than username.
+func checkPhoneFree(st store.Store, username, phone string) error {
+	if phone == "" {
+		return nil
+	}
+	other, err := st.FindUserByPhone(phone)
+	if err != nil {
+		return err
+	}
+	if other != "" && other != username {
+		return phoneTaken(store.ErrPhoneTaken)
+	}
+	return nil
+}
+
+// PhoneViolation is a stored phone number NormalizeStoredPhones could not
+// fix.
+type PhoneViolation struct {
+	Username string
+	Phone    string
+	Error    string
+}
+
+// NormalizeStoredPhones rewrites the stored phone numbers of all users in
+// E.164 form. Numbers that cannot be normalized are left as they are;
+// those and numbers verified for several users are reported and match
+// nobody until fixed.
+func NormalizeStoredPhones(st store.Store, policy PhonePolicy) (fixed int, bad []PhoneViolation, err error) {
+	all := st.ListUserMeta()
+	names := make([]string, 0, len(all))
+	for username := range all {
+		names = append(names, username)
+	}
+	sort.Strings(names)
+
+	owners := make(map[string][]string)
+	for _, username := range names {
+		meta := all[username]
+		if meta.Phone == "" {
+			continue
+		}
+		phone, err := policy.Normalize(meta.Phone)
+		if err != nil {
+			bad = append(bad, PhoneViolation{Username: username, Phone: meta.Phone, Error: err.Error()})
+			continue
+		}
+		if meta.PhoneVerifiedAt > 0 {
+			owners[phone] = append(owners[phone], username)
+		}
+		if phone != meta.Phone {
+			meta.Phone = phone
+			all[username] = meta
+			fixed++
+		}
+	}
+	// Numbers that turn out to be verified for several users are
+	// rewritten as well, so that none of their users is picked for them.
+	if fixed > 0 {
+		if err := st.ReplaceUserMeta(all); err != nil {
+			return 0, bad, err
+		}
+	}
+	for phone, users := range owners {
+		if len(users) < 2 {
+			continue
+		}
+		for _, username := range users {
+			bad = append(bad, PhoneViolation{Username: username, Phone: phone,
+				Error: "phone number is also verified for " + strings.Join(otherUsers(users, username), ", ")})
+		}
+	}
+	sort.Slice(bad, func(i, j int) bool { return bad[i].Username < bad[j].Username })
+	return fixed, bad, nil
+}
+
+func otherUsers(users []string, username string) []string {
+	var res []string
+	for _, u := range users {
+		if u != username {
+			res = append(res, u)
+		}
+	}
+	return res
+}
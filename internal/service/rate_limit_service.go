@@ -0,0 +1,224 @@
+package service
+
+import (
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"tinyauth-usermanagement/internal/config"
+)
+
+// Rate limit scopes. Each endpoint family counts attempts separately.
+const (
+	LimitScopeLogin        = "login"
+	LimitScopeResetRequest = "reset-request"
+	LimitScopeSMSRequest   = "sms-request"
+	LimitScopeSMSVerify    = "sms-verify"
+	LimitScopeSignup       = "signup"
+	LimitScopeEmailChange  = "email-change"
+)
+
+// Rate limit key kinds.
+const (
+	LimitKindIP    = "ip"
+	LimitKindUser  = "user"
+	LimitKindPhone = "phone"
+	LimitKindEmail = "email"
+)
+
+// Lockout describes the limiter state of a single key for admins.
+type Lockout struct {
+	Key         string `json:"key"`
+	Failures    int    `json:"failures"`
+	Lockouts    int    `json:"lockouts"`
+	LockedUntil int64  `json:"lockedUntil"`
+}
+
+type limitEntry struct {
+	kind        string
+	failures    int
+	lockouts    int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// RateLimitService counts failed (or, for request endpoints, all)
+// attempts per key and locks a key out once it reaches its limit. Every
+// further lockout of the same key doubles in length up to a maximum.
+type RateLimitService struct {
+	cfg config.Config
+
+	mu        sync.Mutex
+	entries   map[string]*limitEntry
+	lastPrune time.Time
+}
+
+func NewRateLimitService(cfg config.Config) *RateLimitService {
+	return &RateLimitService{cfg: cfg, entries: make(map[string]*limitEntry)}
+}
+
+// LimitKey builds a limiter key such as "login:ip:10.0.0.1".
+func LimitKey(scope, kind, value string) string {
+	return scope + ":" + kind + ":" + strings.ToLower(strings.TrimSpace(value))
+}
+
+// Allow reports whether all keys may make another attempt and, if so,
+// records the attempt against each of them in the same step, so parallel
+// requests cannot all pass before the first failure is counted. Any key
+// that reaches its limit within the window is locked out. If the attempt
+// is denied, Allow returns how long the caller has to wait. Attempts that
+// turn out not to count are handed back with Undo.
+func (s *RateLimitService) Allow(keys ...string) (bool, time.Duration) {
+	if !s.cfg.RateLimitEnabled {
+		return true, 0
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	var wait time.Duration
+	for _, k := range keys {
+		if e, ok := s.entries[k]; ok && e.lockedUntil.After(now) {
+			if d := e.lockedUntil.Sub(now); d > wait {
+				wait = d
+			}
+		}
+	}
+	if wait > 0 {
+		return false, wait
+	}
+
+	window := time.Duration(s.cfg.RateLimitWindowSeconds) * time.Second
+	s.pruneLocked(now, window)
+	for _, k := range keys {
+		e, ok := s.entries[k]
+		if !ok {
+			e = &limitEntry{kind: keyKind(k)}
+			s.entries[k] = e
+		}
+		if now.Sub(e.lastFailure) > window {
+			e.failures = 0
+		}
+		e.failures++
+		e.lastFailure = now
+		if e.failures >= s.maxAttempts(e.kind) {
+			e.lockedUntil = now.Add(s.lockoutDuration(e.lockouts))
+			e.lockouts++
+			e.failures = 0
+		}
+	}
+	return true, 0
+}
+
+// Undo takes back one attempt recorded by Allow against keys, lifting the
+// lockout it caused if it was the attempt that reached the limit.
+func (s *RateLimitService) Undo(keys ...string) {
+	if !s.cfg.RateLimitEnabled {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, k := range keys {
+		e, ok := s.entries[k]
+		switch {
+		case !ok:
+		case e.failures > 0:
+			e.failures--
+		case e.lockedUntil.After(now) && e.lockouts > 0:
+			// Allow locks a key out on the attempt that reaches the limit
+			// and admits none after it, so this is the attempt to take
+			// back or one admitted just before it.
+			e.lockedUntil = time.Time{}
+			e.lockouts--
+			e.failures = s.maxAttempts(e.kind) - 1
+		}
+	}
+}
+
+// Success forgets the failures and lockout history of keys.
+func (s *RateLimitService) Success(keys ...string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, k := range keys {
+		delete(s.entries, k)
+	}
+}
+
+// Lockouts lists every key with recorded failures or an active lockout.
+func (s *RateLimitService) Lockouts() []Lockout {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.pruneLocked(now, time.Duration(s.cfg.RateLimitWindowSeconds)*time.Second)
+	res := make([]Lockout, 0, len(s.entries))
+	for k, e := range s.entries {
+		l := Lockout{Key: k, Failures: e.failures, Lockouts: e.lockouts}
+		if e.lockedUntil.After(now) {
+			l.LockedUntil = e.lockedUntil.Unix()
+		}
+		res = append(res, l)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Key < res[j].Key })
+	return res
+}
+
+// Clear removes a key, lifting any lockout. It reports whether the key existed.
+func (s *RateLimitService) Clear(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, ok := s.entries[key]
+	delete(s.entries, key)
+	return ok
+}
+
+func (s *RateLimitService) maxAttempts(kind string) int {
+	if kind == LimitKindIP {
+		return s.cfg.RateLimitIPMaxAttempts
+	}
+	return s.cfg.RateLimitMaxAttempts
+}
+
+func (s *RateLimitService) lockoutDuration(previous int) time.Duration {
+	d := time.Duration(s.cfg.RateLimitLockoutSeconds) * time.Second
+	max := time.Duration(s.cfg.RateLimitMaxLockoutSeconds) * time.Second
+	for i := 0; i < previous && d < max; i++ {
+		d *= 2
+	}
+	if d > max {
+		d = max
+	}
+	return d
+}
+
+// pruneLocked drops entries that are neither locked nor failed recently.
+// An entry keeps its lockout history until it has been quiet for the
+// maximum lockout duration, so backoff survives between bursts.
+func (s *RateLimitService) pruneLocked(now time.Time, window time.Duration) {
+	if now.Sub(s.lastPrune) < window {
+		return
+	}
+	s.lastPrune = now
+	quiet := window
+	if max := time.Duration(s.cfg.RateLimitMaxLockoutSeconds) * time.Second; max > quiet {
+		quiet = max
+	}
+	for k, e := range s.entries {
+		if e.lockedUntil.Before(now) && now.Sub(e.lastFailure) > quiet {
+			delete(s.entries, k)
+		}
+	}
+}
+
+func keyKind(key string) string {
+	parts := strings.SplitN(key, ":", 3)
+	if len(parts) < 2 {
+		return ""
+	}
+	return parts[1]
+}
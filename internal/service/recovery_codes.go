@@ -0,0 +1,81 @@
+package service
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"math/big"
+	"strings"
+
+	"tinyauth-usermanagement/internal/store"
+)
+
+// recoveryAlphabet avoids characters that are easy to confuse when
+// copied from paper (0/o, 1/l/i).
+const recoveryAlphabet = "abcdefghjkmnpqrstuvwxyz23456789"
+
+// generateRecoveryCodes returns n codes formatted as "xxxxx-xxxxx" together
+// with their hashes. Only the hashes may be persisted.
+func generateRecoveryCodes(n int) (codes, hashes []string, err error) {
+	for i := 0; i < n; i++ {
+		buf := make([]byte, 10)
+		for j := range buf {
+			k, err := rand.Int(rand.Reader, big.NewInt(int64(len(recoveryAlphabet))))
+			if err != nil {
+				return nil, nil, err
+			}
+			buf[j] = recoveryAlphabet[k.Int64()]
+		}
+		code := string(buf[:5]) + "-" + string(buf[5:])
+		codes = append(codes, code)
+		hashes = append(hashes, hashRecoveryCode(code))
+	}
+	return codes, hashes, nil
+}
+
+func hashRecoveryCode(code string) string {
+	norm := strings.ToLower(strings.NewReplacer("-", "", " ", "").Replace(strings.TrimSpace(code)))
+	sum := sha256.Sum256([]byte(norm))
+	return hex.EncodeToString(sum[:])
+}
+
+// consumeRecoveryCode removes code from the user's stored recovery codes.
+// It reports whether the code was valid. The metadata lock keeps a code
+// from being used twice by concurrent requests.
+func consumeRecoveryCode(st store.Store, username, code string) (bool, error) {
+	if strings.TrimSpace(code) == "" {
+		return false, nil
+	}
+	unlock := lockUserMeta(username)
+	defer unlock()
+
+	meta := st.GetUserMeta(username)
+	if meta == nil {
+		return false, nil
+	}
+	h := hashRecoveryCode(code)
+	for i, stored := range meta.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(stored), []byte(h)) == 1 {
+			meta.RecoveryCodes = append(meta.RecoveryCodes[:i:i], meta.RecoveryCodes[i+1:]...)
+			return true, st.SetUserMeta(username, meta)
+		}
+	}
+	return false, nil
+}
+
+// setRecoveryCodes replaces the stored recovery code hashes of a user.
+func setRecoveryCodes(st store.Store, username string, hashes []string) error {
+	unlock := lockUserMeta(username)
+	defer unlock()
+
+	meta := st.GetUserMeta(username)
+	if meta == nil {
+		if len(hashes) == 0 {
+			return nil
+		}
+		meta = &store.UserMeta{}
+	}
+	meta.RecoveryCodes = hashes
+	return st.SetUserMeta(username, meta)
+}
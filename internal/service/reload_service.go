@@ -0,0 +1,251 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"tinyauth-usermanagement/internal/config"
+)
+
+// maxReloadFailures is how many failures ReloadStatus keeps.
+const maxReloadFailures = 20
+
+// Reload failure stages.
+const (
+	ReloadStageReload   = "reload"
+	ReloadStageHealth   = "health"
+	ReloadStageRollback = "rollback"
+)
+
+// ReloadFailure is a single failed reload step.
+type ReloadFailure struct {
+	At    int64  `json:"at"`
+	Stage string `json:"stage"`
+	Error string `json:"error"`
+}
+
+// ReloadStatus is the state of the reload coordinator as shown to admins.
+type ReloadStatus struct {
+	Strategy        string          `json:"strategy"`
+	Pending         bool            `json:"pending"`
+	Running         bool            `json:"running"`
+	Healthy         bool            `json:"healthy"`
+	LastRequestedAt int64           `json:"lastRequestedAt,omitempty"`
+	LastStartedAt   int64           `json:"lastStartedAt,omitempty"`
+	LastFinishedAt  int64           `json:"lastFinishedAt,omitempty"`
+	LastSuccessAt   int64           `json:"lastSuccessAt,omitempty"`
+	LastRollbackAt  int64           `json:"lastRollbackAt,omitempty"`
+	LastError       string          `json:"lastError,omitempty"`
+	LastAttempts    int             `json:"lastAttempts,omitempty"`
+	TotalReloads    int             `json:"totalReloads"`
+	Failures        []ReloadFailure `json:"failures"`
+}
+
+// ReloadService coalesces users file mutations and reloads tinyauth in
+// the background through the configured Reloader. Every Request pushes
+// the reload back by the debounce window, so a burst of mutations results
+// in a single reload. Requests arriving while a reload runs schedule
+// exactly one more afterwards.
+//
+// After a reload it waits for tinyauth to become healthy. If it does not
+// and rollback is enabled, the users file tinyauth last started with is
+// restored and tinyauth is reloaded once more.
+type ReloadService struct {
+	cfg      config.Config
+	reloader Reloader
+	health   HealthChecker
+	users    *UserFileService
+
+	mu       sync.Mutex
+	timer    *time.Timer
+	status   ReloadStatus
+	kick     chan struct{}
+	lastGood []byte
+}
+
+// NewReloadService wires a coordinator. health may be nil, in which case a
+// reload counts as successful as soon as the reloader returns.
+func NewReloadService(cfg config.Config, reloader Reloader, health HealthChecker, users *UserFileService) *ReloadService {
+	return &ReloadService{
+		cfg:      cfg,
+		reloader: reloader,
+		health:   health,
+		users:    users,
+		kick:     make(chan struct{}, 1),
+		status:   ReloadStatus{Strategy: reloader.Name(), Healthy: true, Failures: []ReloadFailure{}},
+	}
+}
+
+// Start takes the current users file as known good and runs the
+// background worker.
+func (s *ReloadService) Start() {
+	if data, err := s.users.Snapshot(); err != nil {
+		log.Printf("[reload] snapshot users file: %v", err)
+	} else {
+		s.lastGood = data
+	}
+	go func() {
+		for range s.kick {
+			s.run()
+		}
+	}()
+}
+
+// Request schedules a tinyauth reload after the debounce window.
+func (s *ReloadService) Request() {
+	window := time.Duration(s.cfg.ReloadDebounceMillis) * time.Millisecond
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.status.Pending = true
+	s.status.LastRequestedAt = time.Now().Unix()
+	if s.timer == nil {
+		s.timer = time.AfterFunc(window, s.fire)
+	} else {
+		s.timer.Reset(window)
+	}
+}
+
+// Status returns a snapshot of the coordinator state.
+func (s *ReloadService) Status() ReloadStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.status
+	st.Failures = append([]ReloadFailure(nil), s.status.Failures...)
+	return st
+}
+
+func (s *ReloadService) fire() {
+	select {
+	case s.kick <- struct{}{}:
+	default: // a run is already queued and will pick this up
+	}
+}
+
+func (s *ReloadService) run() {
+	s.mu.Lock()
+	s.status.Pending = false
+	s.status.Running = true
+	s.status.LastStartedAt = time.Now().Unix()
+	s.mu.Unlock()
+
+	applied, snapErr := s.users.Snapshot()
+	if snapErr != nil {
+		log.Printf("[reload] snapshot users file: %v", snapErr)
+	}
+
+	healthy := false
+	attempts, stage, err := s.reloadAndWait()
+	if err != nil && stage == ReloadStageHealth && s.cfg.ReloadRollback && s.lastGood != nil && snapErr == nil && !bytes.Equal(applied, s.lastGood) {
+		healthy, stage, err = s.rollback(applied, err)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := time.Now().Unix()
+	s.status.Running = false
+	s.status.LastFinishedAt = now
+	s.status.LastAttempts = attempts
+	s.status.TotalReloads++
+	if err != nil {
+		s.status.Healthy = healthy
+		s.status.LastError = err.Error()
+		s.recordFailureLocked(stage, err)
+		log.Printf("[reload] %s failed after %d attempt(s): %v", stage, attempts, err)
+		return
+	}
+	s.status.Healthy = true
+	s.status.LastError = ""
+	s.status.LastSuccessAt = now
+	if snapErr == nil {
+		s.lastGood = applied
+	}
+	log.Printf("[reload] tinyauth reloaded (%s)", s.reloader.Name())
+}
+
+// reloadAndWait reloads tinyauth, retrying failed reloads with a doubling
+// delay, then waits for it to become healthy. It returns the stage that
+// failed, if any.
+func (s *ReloadService) reloadAndWait() (int, string, error) {
+	var err error
+	attempts := 0
+	delay := time.Duration(s.cfg.ReloadRetryDelaySeconds) * time.Second
+	for attempts <= s.cfg.ReloadMaxRetries {
+		attempts++
+		if err = s.reload(); err == nil {
+			break
+		}
+		log.Printf("[reload] attempt %d failed: %v", attempts, err)
+		if attempts <= s.cfg.ReloadMaxRetries {
+			time.Sleep(delay)
+			delay *= 2
+		}
+	}
+	if err != nil {
+		return attempts, ReloadStageReload, err
+	}
+	if err := s.waitHealthy(); err != nil {
+		return attempts, ReloadStageHealth, err
+	}
+	return attempts, "", nil
+}
+
+// rollback restores the last users file tinyauth was healthy with and
+// reloads again. It reports whether tinyauth came back and the stage that
+// failed; the returned error is never nil, since the requested changes were
+// not applied. If the users file changed since applied was reloaded, those
+// newer changes are kept and only the failed health check is reported;
+// their own reload is already scheduled.
+func (s *ReloadService) rollback(applied []byte, cause error) (bool, string, error) {
+	log.Printf("[reload] tinyauth unhealthy, rolling back users file: %v", cause)
+	if err := s.users.RestoreIfUnchanged(applied, s.lastGood); err != nil {
+		if errors.Is(err, ErrUsersFileConflict) {
+			log.Printf("[reload] users file changed during the health check, not rolling back")
+			return false, ReloadStageHealth, cause
+		}
+		s.recordFailure(ReloadStageHealth, cause)
+		return false, ReloadStageRollback, fmt.Errorf("restore users file: %w", err)
+	}
+	s.recordFailure(ReloadStageHealth, cause)
+	s.mu.Lock()
+	s.status.LastRollbackAt = time.Now().Unix()
+	s.mu.Unlock()
+	if _, _, err := s.reloadAndWait(); err != nil {
+		return false, ReloadStageRollback, fmt.Errorf("reload after rollback: %w", err)
+	}
+	return true, ReloadStageRollback, fmt.Errorf("rolled back users file: %w", cause)
+}
+
+func (s *ReloadService) reload() error {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.ReloadTimeoutSeconds)*time.Second)
+	defer cancel()
+	return s.reloader.Reload(ctx)
+}
+
+func (s *ReloadService) waitHealthy() error {
+	if s.health == nil {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Duration(s.cfg.ReloadHealthTimeoutSeconds)*time.Second)
+	defer cancel()
+	return s.health.WaitHealthy(ctx)
+}
+
+func (s *ReloadService) recordFailure(stage string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.recordFailureLocked(stage, err)
+}
+
+func (s *ReloadService) recordFailureLocked(stage string, err error) {
+	s.status.Failures = append(s.status.Failures, ReloadFailure{At: time.Now().Unix(), Stage: stage, Error: err.Error()})
+	if n := len(s.status.Failures); n > maxReloadFailures {
+		s.status.Failures = s.status.Failures[n-maxReloadFailures:]
+	}
+}
@@ -0,0 +1,143 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os/exec"
+	"strings"
+
+	"tinyauth-usermanagement/internal/config"
+)
+
+// Reload strategies selectable through RELOAD_STRATEGY.
+const (
+	ReloadStrategyDockerRestart = "docker-restart"
+	ReloadStrategyDockerSignal  = "docker-signal"
+	ReloadStrategyCommand       = "command"
+	ReloadStrategyHTTP          = "http"
+	ReloadStrategySwarm         = "swarm"
+	ReloadStrategyNoop          = "noop"
+)
+
+// Reloader makes tinyauth pick up a changed users file.
+type Reloader interface {
+	Reload(ctx context.Context) error
+	Name() string
+}
+
+// NewReloader builds the reloader selected by cfg.ReloadStrategy.
+func NewReloader(cfg config.Config) (Reloader, error) {
+	switch cfg.ReloadStrategy {
+	case "", ReloadStrategyDockerRestart:
+		return &dockerRestartReloader{docker: NewDockerService(cfg)}, nil
+	case ReloadStrategyDockerSignal:
+		return &dockerSignalReloader{docker: NewDockerService(cfg), signal: cfg.ReloadSignal}, nil
+	case ReloadStrategyCommand:
+		if strings.TrimSpace(cfg.ReloadCommand) == "" {
+			return nil, fmt.Errorf("RELOAD_COMMAND is required for reload strategy %q", cfg.ReloadStrategy)
+		}
+		return &commandReloader{command: cfg.ReloadCommand}, nil
+	case ReloadStrategyHTTP:
+		if cfg.ReloadHTTPURL == "" {
+			return nil, fmt.Errorf("RELOAD_HTTP_URL is required for reload strategy %q", cfg.ReloadStrategy)
+		}
+		headers := map[string]string{}
+		if cfg.ReloadHTTPHeaders != "" {
+			if err := json.Unmarshal([]byte(cfg.ReloadHTTPHeaders), &headers); err != nil {
+				return nil, fmt.Errorf("parse RELOAD_HTTP_HEADERS: %w", err)
+			}
+		}
+		return &httpReloader{url: cfg.ReloadHTTPURL, method: strings.ToUpper(cfg.ReloadHTTPMethod), headers: headers}, nil
+	case ReloadStrategySwarm:
+		name := cfg.TinyauthServiceName
+		if name == "" {
+			name = cfg.TinyauthContainerName
+		}
+		return &swarmReloader{docker: NewDockerService(cfg), service: name}, nil
+	case ReloadStrategyNoop:
+		return noopReloader{}, nil
+	}
+	return nil, fmt.Errorf("unknown reload strategy %q", cfg.ReloadStrategy)
+}
+
+type dockerRestartReloader struct{ docker *DockerService }
+
+func (r *dockerRestartReloader) Name() string { return ReloadStrategyDockerRestart }
+
+func (r *dockerRestartReloader) Reload(ctx context.Context) error {
+	return r.docker.RestartTinyauth(ctx)
+}
+
+type dockerSignalReloader struct {
+	docker *DockerService
+	signal string
+}
+
+func (r *dockerSignalReloader) Name() string { return ReloadStrategyDockerSignal }
+
+func (r *dockerSignalReloader) Reload(ctx context.Context) error {
+	return r.docker.SignalTinyauth(ctx, r.signal)
+}
+
+type swarmReloader struct {
+	docker  *DockerService
+	service string
+}
+
+func (r *swarmReloader) Name() string { return ReloadStrategySwarm }
+
+func (r *swarmReloader) Reload(ctx context.Context) error {
+	return r.docker.ForceUpdateService(ctx, r.service)
+}
+
+// commandReloader runs a shell command; a non-zero exit is a failure.
+type commandReloader struct{ command string }
+
+func (r *commandReloader) Name() string { return ReloadStrategyCommand }
+
+func (r *commandReloader) Reload(ctx context.Context) error {
+	out, err := exec.CommandContext(ctx, "sh", "-c", r.command).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("reload command failed: %w: %s", err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// httpReloader calls an endpoint; any non-2xx response is a failure.
+type httpReloader struct {
+	url     string
+	method  string
+	headers map[string]string
+}
+
+func (r *httpReloader) Name() string { return ReloadStrategyHTTP }
+
+func (r *httpReloader) Reload(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, r.method, r.url, nil)
+	if err != nil {
+		return fmt.Errorf("create reload request: %w", err)
+	}
+	for k, v := range r.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("reload request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("reload endpoint returned %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return nil
+}
+
+// noopReloader leaves reloading to tinyauth itself or to the operator.
+type noopReloader struct{}
+
+func (noopReloader) Name() string { return ReloadStrategyNoop }
+
+func (noopReloader) Reload(context.Context) error { return nil }
@@ -0,0 +1,61 @@
+package service
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// Purposes of signed tokens. A token signed for one purpose never verifies
+// for another.
+const (
+	tokenPurposeSignup      = "signup-verify"
+	tokenPurposeEmail       = "email-verify"
+	tokenPurposeEmailCancel = "email-cancel"
+	tokenPurposePhone       = "phone-verify"
+)
+
+var errInvalidLink = errors.New("invalid or expired link")
+
+// signToken returns "<id>.<expiresAt>.<mac>", with id base64url encoded
+// and the HMAC-SHA256 of the purpose, id and expiry under secret.
+func signToken(secret, purpose, id string, expiresAt int64) string {
+	payload := base64.RawURLEncoding.EncodeToString([]byte(id)) + "." + strconv.FormatInt(expiresAt, 10)
+	return payload + "." + tokenMAC(secret, purpose, payload)
+}
+
+// verifyToken checks a token from signToken and returns its id.
+func verifyToken(secret, purpose, token string, now int64) (string, error) {
+	i := strings.LastIndexByte(token, '.')
+	if i < 0 {
+		return "", errInvalidLink
+	}
+	payload, mac := token[:i], token[i+1:]
+	if !hmac.Equal([]byte(mac), []byte(tokenMAC(secret, purpose, payload))) {
+		return "", errInvalidLink
+	}
+	rawID, exp, ok := strings.Cut(payload, ".")
+	if !ok {
+		return "", errInvalidLink
+	}
+	expiresAt, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now > expiresAt {
+		return "", errInvalidLink
+	}
+	id, err := base64.RawURLEncoding.DecodeString(rawID)
+	if err != nil {
+		return "", errInvalidLink
+	}
+	return string(id), nil
+}
+
+func tokenMAC(secret, purpose, payload string) string {
+	m := hmac.New(sha256.New, []byte(secret))
+	m.Write([]byte(purpose))
+	m.Write([]byte{0})
+	m.Write([]byte(payload))
+	return base64.RawURLEncoding.EncodeToString(m.Sum(nil))
+}
@@ -1,13 +1,18 @@
 package service
 
 import (
-	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"log"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"tinyauth-usermanagement/internal/config"
 )
@@ -18,9 +23,33 @@ type UserRecord struct {
 	TotpSecret string
 }
 
+// ErrUsersFileConflict is returned when the users file changed on disk
+// between reading and writing it, e.g. by a hand edit or another replica.
+var ErrUsersFileConflict = errors.New("users file was changed by someone else, try again")
+
+// ErrUserExists is returned when creating or renaming a user to a name
+// that is already taken.
+var ErrUserExists = errors.New("user already exists")
+
+// UserFileService reads and writes the tinyauth users file. Writes take
+// an advisory flock on a .lock file next to it, so replicas sharing the
+// file serialize, and refuse to overwrite changes made without the lock.
 type UserFileService struct {
 	cfg config.Config
 	mu  sync.Mutex
+
+	lastMalformed string // malformed line numbers last logged
+
+	// cache is the parsed file as of stamp; known indexes its users by
+	// folded username. knownSum is the checksum of that content: a file
+	// that differs from it was changed externally.
+	cache      *usersFile
+	stamp      os.FileInfo
+	knownSum   string
+	known      map[string]UserRecord
+	handlersMu sync.Mutex
+	handlers   []func([]UserChange)
+	onWrite    []func([]byte)
 }
 
 func NewUserFileService(cfg config.Config) *UserFileService {
@@ -51,103 +80,385 @@ func (s *UserFileService) ReadAll() ([]UserRecord, error) {
 	return s.readAllNoLock()
 }
 
+// readAllNoLock returns the users in the file. Malformed lines are skipped
+// and logged, unless USERS_FILE_STRICT is set, in which case the first one
+// fails the read.
 func (s *UserFileService) readAllNoLock() ([]UserRecord, error) {
-	f, err := os.Open(s.cfg.UsersFilePath)
-	if errors.Is(err, os.ErrNotExist) {
-		return []UserRecord{}, nil
+	f, err := s.readFileNoLock()
+	if err != nil {
+		return nil, err
 	}
+	return f.records(), nil
+}
+
+// readFileNoLock returns the cached users file, re-reading it only when
+// its inode, size or mtime changed. Callers must not modify the result.
+func (s *UserFileService) readFileNoLock() (*usersFile, error) {
+	fi, err := os.Stat(s.cfg.UsersFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+	if s.cache != nil && sameStamp(s.stamp, fi) {
+		return s.cache, nil
+	}
+	data, err := s.readRawNoLock()
+	if err != nil {
+		return nil, err
+	}
+	f, err := s.parseNoLock(data)
 	if err != nil {
+		s.cache = nil
 		return nil, err
 	}
-	defer f.Close()
+	s.cache, s.stamp = f, fi
+	return f, nil
+}
+
+// invalidateNoLock drops the cache so the next read goes to disk.
+func (s *UserFileService) invalidateNoLock() {
+	s.cache, s.stamp = nil, nil
+}
+
+func sameStamp(a, b os.FileInfo) bool {
+	if a == nil || b == nil {
+		return a == nil && b == nil
+	}
+	return os.SameFile(a, b) && a.Size() == b.Size() && a.ModTime().Equal(b.ModTime())
+}
 
-	var users []UserRecord
-	scanner := bufio.NewScanner(f)
-	for scanner.Scan() {
-		line := strings.TrimSpace(scanner.Text())
-		if line == "" {
-			continue
+func (s *UserFileService) parseNoLock(data []byte) (*usersFile, error) {
+	f, err := parseUsersFile(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	s.observeNoLock(data, f, true)
+	if err := f.firstError(); err != nil {
+		if s.cfg.UsersFileStrict {
+			return nil, err
 		}
-		u, err := ParseUserLine(line)
-		if err != nil {
-			return nil, fmt.Errorf("bad user line %q: %w", line, err)
+		s.reportMalformedNoLock(f)
+	} else {
+		s.lastMalformed = ""
+	}
+	return f, nil
+}
+
+// reportMalformedNoLock logs skipped lines once per distinct set, since
+// the file is read on every request.
+func (s *UserFileService) reportMalformedNoLock(f *usersFile) {
+	var lines []string
+	for i, l := range f.lines {
+		if l.err != nil {
+			lines = append(lines, strconv.Itoa(i+1))
 		}
-		users = append(users, u)
 	}
-	return users, scanner.Err()
+	sig := strings.Join(lines, ",")
+	if sig == s.lastMalformed {
+		return
+	}
+	s.lastMalformed = sig
+	log.Printf("[users] skipping malformed line(s) %s in %s; run the admin users file doctor", sig, s.cfg.UsersFilePath)
 }
 
+// Find looks a user up by case-insensitive name through the index.
 func (s *UserFileService) Find(username string) (UserRecord, bool, error) {
-	users, err := s.ReadAll()
-	if err != nil {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.readFileNoLock(); err != nil {
 		return UserRecord{}, false, err
 	}
-	for _, u := range users {
-		if strings.EqualFold(u.Username, username) {
-			return u, true, nil
-		}
-	}
-	return UserRecord{}, false, nil
+	u, ok := s.known[strings.ToLower(username)]
+	return u, ok, nil
 }
 
 func (s *UserFileService) Upsert(user UserRecord) error {
+	return s.UpsertMany([]UserRecord{user})
+}
+
+// UpsertMany inserts or replaces several users with a single file write.
+func (s *UserFileService) UpsertMany(records []UserRecord) error {
+	return s.modify(func(f *usersFile) error {
+		for _, user := range records {
+			f.upsert(user)
+		}
+		return nil
+	})
+}
+
+// Create adds a user that must not exist yet.
+func (s *UserFileService) Create(user UserRecord) error {
+	return s.modify(func(f *usersFile) error {
+		if f.index(user.Username) >= 0 {
+			return ErrUserExists
+		}
+		f.upsert(user)
+		return nil
+	})
+}
+
+func (s *UserFileService) Delete(username string) error {
+	return s.modify(func(f *usersFile) error {
+		f.remove(username)
+		return nil
+	})
+}
+
+// Rename changes the username of an existing user. It fails if the new
+// name is taken by anyone else.
+func (s *UserFileService) Rename(oldName, newName string) error {
+	return s.modify(func(f *usersFile) error {
+		idx := f.index(oldName)
+		if idx < 0 {
+			return errors.New("not found")
+		}
+		if j := f.index(newName); j >= 0 && j != idx {
+			return ErrUserExists
+		}
+		f.rename(idx, newName)
+		return nil
+	})
+}
+
+// modify runs a read-modify-write of the users file under the process
+// mutex and the file lock.
+func (s *UserFileService) modify(fn func(f *usersFile) error) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	users, err := s.readAllNoLock()
+	unlock, err := s.lockNoLock()
+	if err != nil {
+		return err
+	}
+	defer unlock()
+
+	data, err := s.readRawNoLock()
+	if err != nil {
+		return err
+	}
+	f, err := s.parseNoLock(data)
+	if err != nil {
+		return err
+	}
+	if err := fn(f); err != nil {
+		return err
+	}
+	return s.replaceNoLock(data, f)
+}
+
+func (s *UserFileService) lockNoLock() (func(), error) {
+	if err := os.MkdirAll(filepath.Dir(s.cfg.UsersFilePath), 0o755); err != nil {
+		return nil, err
+	}
+	unlock, err := lockFile(s.cfg.UsersFilePath + ".lock")
+	if err != nil {
+		return nil, fmt.Errorf("lock users file: %w", err)
+	}
+	return unlock, nil
+}
+
+// replaceNoLock atomically replaces the users file with f, provided it
+// still holds base. Writers that ignore the flock (editors, scripts) are
+// detected here instead of being overwritten. The cache becomes f, and
+// only the users f touched are re-indexed.
+func (s *UserFileService) replaceNoLock(base []byte, f *usersFile) error {
+	out := f.bytes()
+	current, err := s.readRawNoLock()
 	if err != nil {
 		return err
 	}
-	replaced := false
-	for i := range users {
-		if strings.EqualFold(users[i].Username, user.Username) {
-			users[i] = user
-			replaced = true
-			break
+	if !bytes.Equal(current, base) {
+		log.Printf("[users] %s changed during a write, refusing to overwrite it", s.cfg.UsersFilePath)
+		return ErrUsersFileConflict
+	}
+	tmp := s.cfg.UsersFilePath + ".tmp"
+	if err := os.WriteFile(tmp, out, 0o644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, s.cfg.UsersFilePath); err != nil {
+		s.invalidateNoLock()
+		return err
+	}
+	s.handlersMu.Lock()
+	hooks := append([]func([]byte){}, s.onWrite...)
+	s.handlersMu.Unlock()
+	for _, fn := range hooks {
+		fn(out)
+	}
+	fi, err := os.Stat(s.cfg.UsersFilePath)
+	if err != nil || f.touched == nil || s.known == nil {
+		// Not incremental: rebuild from disk on the next read.
+		s.invalidateNoLock()
+		s.knownSum, s.known = usersFileChecksum(out), recordIndex(f.records())
+		return nil
+	}
+	for key := range f.touched {
+		if i := f.index(key); i >= 0 {
+			s.known[key] = *f.lines[i].record
+		} else {
+			delete(s.known, key)
 		}
 	}
-	if !replaced {
-		users = append(users, user)
+	f.touched = nil
+	s.knownSum = usersFileChecksum(out)
+	s.cache, s.stamp = f, fi
+	return nil
+}
+
+// UsersFileDiagnosis is the doctor report for the users file. Checksum
+// identifies the exact content that was examined.
+type UsersFileDiagnosis struct {
+	Path     string           `json:"path"`
+	Checksum string           `json:"checksum"`
+	Lines    int              `json:"lines"`
+	Users    int              `json:"users"`
+	Issues   []UsersFileIssue `json:"issues"`
+}
+
+// Diagnose reports every problem in the users file.
+func (s *UserFileService) Diagnose(policy UsernamePolicy) (UsersFileDiagnosis, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	data, err := s.readRawNoLock()
+	if err != nil {
+		return UsersFileDiagnosis{}, err
+	}
+	f, err := parseUsersFile(bytes.NewReader(data))
+	if err != nil {
+		return UsersFileDiagnosis{}, err
 	}
-	return s.writeAllNoLock(users)
+	return s.diagnosis(data, f, policy), nil
 }
 
-func (s *UserFileService) Delete(username string) error {
+// Repair fixes the fixable issues found by Diagnose. checksum must match
+// the diagnosis the caller confirmed, so a file that changed in between
+// is left alone. The previous file is kept next to it as a .bak copy.
+// It returns the diagnosis of the repaired file and whether it changed.
+func (s *UserFileService) Repair(checksum string, policy UsernamePolicy) (UsersFileDiagnosis, bool, error) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	users, err := s.readAllNoLock()
+	unlock, err := s.lockNoLock()
 	if err != nil {
-		return err
+		return UsersFileDiagnosis{}, false, err
+	}
+	defer unlock()
+	data, err := s.readRawNoLock()
+	if err != nil {
+		return UsersFileDiagnosis{}, false, err
+	}
+	if checksum != usersFileChecksum(data) {
+		return UsersFileDiagnosis{}, false, errors.New("users file changed since the diagnosis, run the doctor again")
+	}
+	f, err := parseUsersFile(bytes.NewReader(data))
+	if err != nil {
+		return UsersFileDiagnosis{}, false, err
+	}
+	removed := f.repair()
+	out := f.bytes()
+	if bytes.Equal(out, data) {
+		return s.diagnosis(data, f, policy), false, nil
+	}
+	backup := fmt.Sprintf("%s.bak-%d", s.cfg.UsersFilePath, time.Now().Unix())
+	if err := os.WriteFile(backup, data, 0o600); err != nil {
+		return UsersFileDiagnosis{}, false, fmt.Errorf("write backup: %w", err)
+	}
+	f.touched = nil // every line may have changed
+	if err := s.replaceNoLock(data, f); err != nil {
+		return UsersFileDiagnosis{}, false, err
+	}
+	s.lastMalformed = ""
+	log.Printf("[users] repaired %s: removed %d line(s), backup at %s", s.cfg.UsersFilePath, removed, backup)
+	return s.diagnosis(out, f, policy), true, nil
+}
+
+func (s *UserFileService) diagnosis(data []byte, f *usersFile, policy UsernamePolicy) UsersFileDiagnosis {
+	issues := f.issues(policy)
+	if issues == nil {
+		issues = []UsersFileIssue{}
 	}
-	newUsers := make([]UserRecord, 0, len(users))
+	return UsersFileDiagnosis{
+		Path:     s.cfg.UsersFilePath,
+		Checksum: usersFileChecksum(data),
+		Lines:    len(f.lines),
+		Users:    len(f.records()),
+		Issues:   issues,
+	}
+}
+
+func (s *UserFileService) readRawNoLock() ([]byte, error) {
+	data, err := os.ReadFile(s.cfg.UsersFilePath)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	return data, err
+}
+
+func usersFileChecksum(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// UsernameViolation is an existing user whose name breaks the policy.
+type UsernameViolation struct {
+	Username string `json:"username"`
+	Code     string `json:"code"`
+	Error    string `json:"error"`
+}
+
+// CheckUsernames lists existing users whose names break policy.
+func (s *UserFileService) CheckUsernames(policy UsernamePolicy) ([]UsernameViolation, error) {
+	users, err := s.ReadAll()
+	if err != nil {
+		return nil, err
+	}
+	var res []UsernameViolation
 	for _, u := range users {
-		if !strings.EqualFold(u.Username, username) {
-			newUsers = append(newUsers, u)
+		var ve *ValidationError
+		if err := policy.Validate(u.Username); errors.As(err, &ve) {
+			res = append(res, UsernameViolation{Username: u.Username, Code: ve.Code, Error: ve.Message})
 		}
 	}
-	return s.writeAllNoLock(newUsers)
+	return res, nil
 }
 
-func (s *UserFileService) writeAllNoLock(users []UserRecord) error {
-	if err := os.MkdirAll(filepath.Dir(s.cfg.UsersFilePath), 0o755); err != nil {
+// Snapshot returns the raw users file, or nil if it does not exist yet.
+func (s *UserFileService) Snapshot() ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readRawNoLock()
+}
+
+// Restore replaces the users file with a snapshot, whatever it holds now.
+func (s *UserFileService) Restore(data []byte) error {
+	return s.restore(nil, data)
+}
+
+// RestoreIfUnchanged replaces the users file with a snapshot only if it
+// still holds expected, and fails with ErrUsersFileConflict otherwise.
+func (s *UserFileService) RestoreIfUnchanged(expected, data []byte) error {
+	if expected == nil {
+		expected = []byte{}
+	}
+	return s.restore(expected, data)
+}
+
+func (s *UserFileService) restore(expected, data []byte) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	unlock, err := s.lockNoLock()
+	if err != nil {
 		return err
 	}
-	tmp := s.cfg.UsersFilePath + ".tmp"
-	f, err := os.Create(tmp)
+	defer unlock()
+	current, err := s.readRawNoLock()
 	if err != nil {
 		return err
 	}
-	for _, u := range users {
-		line := u.Username + ":" + u.Password
-		if strings.TrimSpace(u.TotpSecret) != "" {
-			line += ":" + strings.TrimSpace(u.TotpSecret)
-		}
-		if _, err := f.WriteString(line + "\n"); err != nil {
-			f.Close()
-			return err
-		}
+	if expected != nil && !bytes.Equal(current, expected) {
+		return ErrUsersFileConflict
 	}
-	if err := f.Close(); err != nil {
+	f, err := parseUsersFile(bytes.NewReader(data))
+	if err != nil {
 		return err
 	}
-	return os.Rename(tmp, s.cfg.UsersFilePath)
+	f.touched = nil // a different file altogether
+	return s.replaceNoLock(current, f)
 }
@@ -0,0 +1,46 @@
+package service
+
+import (
+	"strings"
+	"sync"
+)
+
+// metaLocks serialises read-modify-write cycles on the metadata of a user
+// across services, so that concurrent phone, email and recovery code
+// changes of one user do not overwrite each other's fields.
+var metaLocks = userLocks{locks: make(map[string]*userLock)}
+
+type userLocks struct {
+	mu    sync.Mutex
+	locks map[string]*userLock
+}
+
+type userLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lockUserMeta locks the metadata of username, ignoring case, until the
+// returned function is called. It must not be called again for the same
+// user before that.
+func lockUserMeta(username string) (unlock func()) {
+	key := strings.ToLower(username)
+	metaLocks.mu.Lock()
+	l, ok := metaLocks.locks[key]
+	if !ok {
+		l = &userLock{}
+		metaLocks.locks[key] = l
+	}
+	l.refs++
+	metaLocks.mu.Unlock()
+
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		metaLocks.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(metaLocks.locks, key)
+		}
+		metaLocks.mu.Unlock()
+	}
+}
@@ -0,0 +1,112 @@
+package service
+
+import (
+	"fmt"
+	"strings"
+
+	"tinyauth-usermanagement/internal/config"
+)
+
+// Validation error codes returned to clients in the "code" field.
+const (
+	ValidationRequired     = "required"
+	ValidationTooShort     = "too_short"
+	ValidationTooLong      = "too_long"
+	ValidationInvalidChars = "invalid_chars"
+	ValidationInvalidStart = "invalid_start"
+	ValidationReserved     = "reserved"
+	ValidationNotFolded    = "not_lowercase"
+	ValidationInvalidEmail = "invalid_email"
+	ValidationInvalidPhone = "invalid_phone"
+	ValidationPhoneTaken   = "phone_taken"
+)
+
+// ValidationError is an input error that clients can map to a form field.
+type ValidationError struct {
+	Field   string `json:"field"`
+	Code    string `json:"code"`
+	Message string `json:"error"`
+}
+
+func (e *ValidationError) Error() string { return e.Message }
+
+// UsernamePolicy decides which usernames may be written to the users file.
+// Names are restricted to ASCII letters (lowercase only when folding),
+// digits and ".", "_", "-", "@" and must start with a letter or digit,
+// which keeps ":" (the field separator) and whitespace out of users.txt.
+type UsernamePolicy struct {
+	MinLength int
+	MaxLength int
+	Fold      bool
+	Reserved  map[string]bool
+}
+
+// NewUsernamePolicy builds the policy from USERNAME_* settings.
+func NewUsernamePolicy(cfg config.Config) UsernamePolicy {
+	reserved := make(map[string]bool, len(cfg.UsernameReserved))
+	for _, r := range cfg.UsernameReserved {
+		reserved[strings.ToLower(r)] = true
+	}
+	return UsernamePolicy{
+		MinLength: cfg.UsernameMinLength,
+		MaxLength: cfg.UsernameMaxLength,
+		Fold:      cfg.UsernameCaseFold,
+		Reserved:  reserved,
+	}
+}
+
+// Normalize trims and, if case folding is on, lowercases name, then
+// validates it. It returns the name to store.
+func (p UsernamePolicy) Normalize(name string) (string, error) {
+	name = strings.TrimSpace(name)
+	if p.Fold {
+		name = strings.ToLower(name)
+	}
+	return name, p.Validate(name)
+}
+
+// Validate checks name as stored, without normalizing it.
+func (p UsernamePolicy) Validate(name string) error {
+	if name == "" {
+		return usernameError(ValidationRequired, "username required")
+	}
+	if n := len(name); n < p.MinLength {
+		return usernameError(ValidationTooShort, fmt.Sprintf("username must be at least %d characters", p.MinLength))
+	} else if p.MaxLength > 0 && n > p.MaxLength {
+		return usernameError(ValidationTooLong, fmt.Sprintf("username must be at most %d characters", p.MaxLength))
+	}
+	for _, r := range name {
+		if !usernameRune(r) {
+			return usernameError(ValidationInvalidChars, fmt.Sprintf("username contains invalid character %q", r))
+		}
+	}
+	if !isAlnum(rune(name[0])) {
+		return usernameError(ValidationInvalidStart, "username must start with a letter or digit")
+	}
+	if p.Fold && strings.ToLower(name) != name {
+		return usernameError(ValidationNotFolded, "username must be lowercase")
+	}
+	if p.Reserved[strings.ToLower(name)] {
+		return usernameError(ValidationReserved, "username is reserved")
+	}
+	return nil
+}
+
+func usernameError(code, msg string) *ValidationError {
+	return &ValidationError{Field: "username", Code: code, Message: msg}
+}
+
+func usernameRune(r rune) bool {
+	if isAlnum(r) {
+		return true
+	}
+	switch r {
+	case '.', '_', '-', '@':
+		return true
+	}
+	return false
+}
+
+func isAlnum(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= 'A' && r <= 'Z') || (r >= '0' && r <= '9')
+}
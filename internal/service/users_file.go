@@ -0,0 +1,206 @@
+package service
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// Users file issue kinds reported by the doctor.
+const (
+	IssueMalformed = "malformed"
+	IssueDuplicate = "duplicate"
+	IssueUsername  = "username"
+	IssueHash      = "hash"
+)
+
+// UsersFileIssue is a problem found on one line of the users file.
+type UsersFileIssue struct {
+	Line     int    `json:"line"`
+	Kind     string `json:"kind"`
+	Username string `json:"username,omitempty"`
+	Message  string `json:"message"`
+	// Fixable reports whether Repair resolves the issue.
+	Fixable bool `json:"fixable"`
+}
+
+// usersFileLine is one line of the users file. record is nil for blank
+// lines, comments and malformed lines; err is set for malformed lines.
+type usersFileLine struct {
+	raw    string
+	record *UserRecord
+	err    error
+}
+
+// usersFile is the users file as written, so that rewriting it keeps
+// comments, blank lines and the order of entries.
+type usersFile struct {
+	lines []usersFileLine
+	// touched holds the folded usernames changed since parsing, so the
+	// index can be updated without a full rebuild.
+	touched map[string]bool
+}
+
+func parseUsersFile(r io.Reader) (*usersFile, error) {
+	f := &usersFile{touched: make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		raw := scanner.Text()
+		line := usersFileLine{raw: raw}
+		trimmed := strings.TrimSpace(raw)
+		if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+			if u, err := ParseUserLine(trimmed); err != nil {
+				line.err = err
+			} else {
+				line.record = &u
+			}
+		}
+		f.lines = append(f.lines, line)
+	}
+	return f, scanner.Err()
+}
+
+func formatUserLine(u UserRecord) string {
+	line := u.Username + ":" + u.Password
+	if strings.TrimSpace(u.TotpSecret) != "" {
+		line += ":" + strings.TrimSpace(u.TotpSecret)
+	}
+	return line
+}
+
+// records returns every well-formed entry, duplicates included.
+func (f *usersFile) records() []UserRecord {
+	res := make([]UserRecord, 0, len(f.lines))
+	for _, l := range f.lines {
+		if l.record != nil {
+			res = append(res, *l.record)
+		}
+	}
+	return res
+}
+
+// firstError returns the first malformed line as an error, or nil.
+func (f *usersFile) firstError() error {
+	for i, l := range f.lines {
+		if l.err != nil {
+			return fmt.Errorf("bad user line %d %q: %w", i+1, l.raw, l.err)
+		}
+	}
+	return nil
+}
+
+// index returns the line of the first entry for username, or -1.
+func (f *usersFile) index(username string) int {
+	for i, l := range f.lines {
+		if l.record != nil && strings.EqualFold(l.record.Username, username) {
+			return i
+		}
+	}
+	return -1
+}
+
+// upsert replaces the first entry for u.Username in place or appends one.
+func (f *usersFile) upsert(u UserRecord) {
+	f.touch(u.Username)
+	line := usersFileLine{raw: formatUserLine(u), record: &u}
+	if i := f.index(u.Username); i >= 0 {
+		f.lines[i] = line
+		return
+	}
+	f.lines = append(f.lines, line)
+}
+
+// remove drops every entry for username.
+func (f *usersFile) remove(username string) {
+	f.touch(username)
+	kept := f.lines[:0]
+	for _, l := range f.lines {
+		if l.record == nil || !strings.EqualFold(l.record.Username, username) {
+			kept = append(kept, l)
+		}
+	}
+	f.lines = kept
+}
+
+// rename changes the name of the entry on line i.
+func (f *usersFile) rename(i int, newName string) {
+	u := *f.lines[i].record
+	f.touch(u.Username)
+	f.touch(newName)
+	u.Username = newName
+	f.lines[i] = usersFileLine{raw: formatUserLine(u), record: &u}
+}
+
+func (f *usersFile) touch(username string) {
+	if f.touched != nil {
+		f.touched[strings.ToLower(username)] = true
+	}
+}
+
+func (f *usersFile) bytes() []byte {
+	var b bytes.Buffer
+	for _, l := range f.lines {
+		b.WriteString(l.raw)
+		b.WriteByte('\n')
+	}
+	return b.Bytes()
+}
+
+// issues lists malformed lines, duplicate users, names that break policy
+// and passwords that are not bcrypt hashes.
+func (f *usersFile) issues(policy UsernamePolicy) []UsersFileIssue {
+	var res []UsersFileIssue
+	seen := make(map[string]int)
+	for i, l := range f.lines {
+		n := i + 1
+		if l.err != nil {
+			res = append(res, UsersFileIssue{Line: n, Kind: IssueMalformed, Message: l.err.Error(), Fixable: true})
+			continue
+		}
+		if l.record == nil {
+			continue
+		}
+		u := l.record
+		key := strings.ToLower(u.Username)
+		if first, ok := seen[key]; ok {
+			res = append(res, UsersFileIssue{Line: n, Kind: IssueDuplicate, Username: u.Username,
+				Message: fmt.Sprintf("duplicate of line %d", first), Fixable: true})
+			continue
+		}
+		seen[key] = n
+		if err := policy.Validate(u.Username); err != nil {
+			res = append(res, UsersFileIssue{Line: n, Kind: IssueUsername, Username: u.Username, Message: err.Error()})
+		}
+		if !strings.HasPrefix(u.Password, "$2") {
+			res = append(res, UsersFileIssue{Line: n, Kind: IssueHash, Username: u.Username, Message: "password is not a bcrypt hash"})
+		}
+	}
+	return res
+}
+
+// repair drops malformed lines and repeated entries (the first one wins)
+// and rewrites the remaining entries in canonical form. Comments and blank
+// lines are kept. It returns the number of lines removed.
+func (f *usersFile) repair() int {
+	seen := make(map[string]bool)
+	kept := make([]usersFileLine, 0, len(f.lines))
+	for _, l := range f.lines {
+		if l.err != nil {
+			continue
+		}
+		if l.record != nil {
+			key := strings.ToLower(l.record.Username)
+			if seen[key] {
+				continue
+			}
+			seen[key] = true
+			l.raw = formatUserLine(*l.record)
+		}
+		kept = append(kept, l)
+	}
+	removed := len(f.lines) - len(kept)
+	f.lines = kept
+	return removed
+}
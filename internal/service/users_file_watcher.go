@@ -0,0 +1,172 @@
+package service
+
+import (
+	"log"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+// User change kinds reported for external edits of the users file.
+const (
+	UserAdded   = "added"
+	UserRemoved = "removed"
+	UserUpdated = "updated"
+)
+
+// UserChange is one user entry that changed in the users file.
+type UserChange struct {
+	Username string `json:"username"`
+	Kind     string `json:"kind"`
+}
+
+// watchDebounce coalesces the burst of events a single save produces.
+const watchDebounce = 250 * time.Millisecond
+
+// OnExternalChange registers fn to be called with the users that changed
+// whenever the users file is modified by anything but this process.
+// Handlers run in their own goroutine.
+func (s *UserFileService) OnExternalChange(fn func([]UserChange)) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	s.handlers = append(s.handlers, fn)
+}
+
+// OnWrite registers fn to be called with the new content after every
+// write of the users file by this process. It runs with the file locked,
+// so it sees writes in order and must not call back into the service.
+func (s *UserFileService) OnWrite(fn func(data []byte)) {
+	s.handlersMu.Lock()
+	defer s.handlersMu.Unlock()
+	s.onWrite = append(s.onWrite, fn)
+}
+
+// observeNoLock records data as the known content of the users file. If
+// it was read (rather than written by us) and differs from what we knew,
+// the per-user differences are reported as an external change.
+func (s *UserFileService) observeNoLock(data []byte, f *usersFile, read bool) {
+	sum := usersFileChecksum(data)
+	if sum == s.knownSum {
+		return
+	}
+	prev := s.known
+	s.known = recordIndex(f.records())
+	s.knownSum = sum
+	if !read || prev == nil {
+		return
+	}
+	changes := diffUsers(prev, s.known)
+	if len(changes) == 0 {
+		return
+	}
+	log.Printf("[users] %s changed externally: %d user(s) affected", s.cfg.UsersFilePath, len(changes))
+
+	s.handlersMu.Lock()
+	handlers := append([]func([]UserChange){}, s.handlers...)
+	s.handlersMu.Unlock()
+	if len(handlers) > 0 {
+		go func() {
+			for _, h := range handlers {
+				h(changes)
+			}
+		}()
+	}
+}
+
+// recordIndex maps folded usernames to their first entry.
+func recordIndex(records []UserRecord) map[string]UserRecord {
+	m := make(map[string]UserRecord, len(records))
+	for _, u := range records {
+		key := strings.ToLower(u.Username)
+		if _, ok := m[key]; !ok {
+			m[key] = u
+		}
+	}
+	return m
+}
+
+func diffUsers(prev, next map[string]UserRecord) []UserChange {
+	var res []UserChange
+	for k, u := range next {
+		old, ok := prev[k]
+		switch {
+		case !ok:
+			res = append(res, UserChange{Username: u.Username, Kind: UserAdded})
+		case old != u:
+			res = append(res, UserChange{Username: u.Username, Kind: UserUpdated})
+		}
+	}
+	for k, u := range prev {
+		if _, ok := next[k]; !ok {
+			res = append(res, UserChange{Username: u.Username, Kind: UserRemoved})
+		}
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Username < res[j].Username })
+	return res
+}
+
+// StartWatcher watches the users file with inotify and re-reads it after
+// every change, which refreshes the user index and reports external edits
+// to OnExternalChange handlers. The directory is watched, since every
+// write replaces the file.
+func (s *UserFileService) StartWatcher() (stop func(), err error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+	path := filepath.Clean(s.cfg.UsersFilePath)
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return nil, err
+	}
+	s.refresh() // establish the baseline
+
+	done := make(chan struct{})
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case ev, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(ev.Name) != path || ev.Has(fsnotify.Chmod) {
+					continue
+				}
+				if timer == nil {
+					timer = time.AfterFunc(watchDebounce, s.refresh)
+				} else {
+					timer.Reset(watchDebounce)
+				}
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				log.Printf("[users] watcher: %v", err)
+			case <-done:
+				if timer != nil {
+					timer.Stop()
+				}
+				return
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		w.Close()
+	}, nil
+}
+
+// refresh re-reads the users file even if its stamp looks unchanged, since
+// an edit within the mtime granularity keeps size and mtime.
+func (s *UserFileService) refresh() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.invalidateNoLock()
+	if _, err := s.readFileNoLock(); err != nil {
+		log.Printf("[users] re-read %s: %v", s.cfg.UsersFilePath, err)
+	}
+}
@@ -0,0 +1,480 @@
+package store
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// sessionEntry is an in-memory session record.
+type sessionEntry struct {
+	Username  string
+	CreatedAt int64
+	ExpiresAt int64
+}
+
+// mfaTicket is an in-memory record of a password login that still
+// needs its second factor.
+type mfaTicket struct {
+	Username  string
+	ExpiresAt int64
+	Attempts  int
+}
+
+// totpEnrollment is an in-memory pending TOTP enrollment.
+type totpEnrollment struct {
+	Username  string
+	Secret    string
+	CreatedAt int64
+	ExpiresAt int64
+}
+
+// resetTokenEntry is an in-memory reset token record.
+type resetTokenEntry struct {
+	Username  string
+	ExpiresAt int64
+	Used      bool
+}
+
+// smsResetCode is an in-memory SMS reset code record.
+type smsResetCode struct {
+	Username  string
+	Code      string
+	ExpiresAt int64
+	Used      bool
+	Attempts  int
+}
+
+// MemoryStore keeps everything in maps. Nothing survives a restart, which
+// makes it suitable for tests and throwaway instances.
+type MemoryStore struct {
+	*metaMap
+
+	sessMu   sync.Mutex
+	sessions map[string]*sessionEntry // key = token
+
+	mfaMu      sync.Mutex
+	mfaTickets map[string]*mfaTicket // key = ticket
+
+	enrollMu    sync.Mutex
+	enrollments map[string]*totpEnrollment // key = session token
+
+	resetMu     sync.Mutex
+	resetTokens map[string]*resetTokenEntry // key = token
+
+	signupMu sync.Mutex
+	signups  map[string]PendingSignup // key = id
+
+	smsMu    sync.Mutex
+	smsCodes map[string]*smsResetCode // key = id
+}
+
+// NewMemoryStore creates an empty in-memory store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{
+		metaMap:     newMetaMap(nil),
+		sessions:    make(map[string]*sessionEntry),
+		mfaTickets:  make(map[string]*mfaTicket),
+		enrollments: make(map[string]*totpEnrollment),
+		resetTokens: make(map[string]*resetTokenEntry),
+		signups:     make(map[string]PendingSignup),
+		smsCodes:    make(map[string]*smsResetCode),
+	}
+}
+
+// Close is a no-op for the in-memory store.
+func (s *MemoryStore) Close() error { return nil }
+
+// PurgeExpired deletes every session, ticket, enrollment, token, code and
+// signup that expired before now.
+func (s *MemoryStore) PurgeExpired(now int64) (int64, error) {
+	var n int64
+
+	s.sessMu.Lock()
+	for k, v := range s.sessions {
+		if v.ExpiresAt < now {
+			delete(s.sessions, k)
+			n++
+		}
+	}
+	s.sessMu.Unlock()
+
+	s.mfaMu.Lock()
+	for k, v := range s.mfaTickets {
+		if v.ExpiresAt < now {
+			delete(s.mfaTickets, k)
+			n++
+		}
+	}
+	s.mfaMu.Unlock()
+
+	s.enrollMu.Lock()
+	for k, v := range s.enrollments {
+		if v.ExpiresAt < now {
+			delete(s.enrollments, k)
+			n++
+		}
+	}
+	s.enrollMu.Unlock()
+
+	s.resetMu.Lock()
+	for k, v := range s.resetTokens {
+		if v.ExpiresAt < now {
+			delete(s.resetTokens, k)
+			n++
+		}
+	}
+	s.resetMu.Unlock()
+
+	s.smsMu.Lock()
+	for k, v := range s.smsCodes {
+		if v.ExpiresAt < now {
+			delete(s.smsCodes, k)
+			n++
+		}
+	}
+	s.smsMu.Unlock()
+
+	s.signupMu.Lock()
+	for k, v := range s.signups {
+		if v.ExpiresAt > 0 && v.ExpiresAt < now {
+			delete(s.signups, k)
+			n++
+		}
+	}
+	s.signupMu.Unlock()
+
+	return n, nil
+}
+
+// DeleteUserTokens removes everything issued to username.
+func (s *MemoryStore) DeleteUserTokens(username string) error {
+	s.sessMu.Lock()
+	for k, v := range s.sessions {
+		if strings.EqualFold(v.Username, username) {
+			delete(s.sessions, k)
+		}
+	}
+	s.sessMu.Unlock()
+
+	s.mfaMu.Lock()
+	for k, v := range s.mfaTickets {
+		if strings.EqualFold(v.Username, username) {
+			delete(s.mfaTickets, k)
+		}
+	}
+	s.mfaMu.Unlock()
+
+	s.enrollMu.Lock()
+	for k, v := range s.enrollments {
+		if strings.EqualFold(v.Username, username) {
+			delete(s.enrollments, k)
+		}
+	}
+	s.enrollMu.Unlock()
+
+	s.resetMu.Lock()
+	for k, v := range s.resetTokens {
+		if strings.EqualFold(v.Username, username) {
+			delete(s.resetTokens, k)
+		}
+	}
+	s.resetMu.Unlock()
+
+	s.smsMu.Lock()
+	for k, v := range s.smsCodes {
+		if strings.EqualFold(v.Username, username) {
+			delete(s.smsCodes, k)
+		}
+	}
+	s.smsMu.Unlock()
+
+	return nil
+}
+
+// ---------- Sessions ----------
+
+// CreateSession stores a new session token.
+func (s *MemoryStore) CreateSession(token, username string, createdAt, expiresAt int64) error {
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+
+	s.sessions[token] = &sessionEntry{
+		Username:  username,
+		CreatedAt: createdAt,
+		ExpiresAt: expiresAt,
+	}
+	return nil
+}
+
+// GetSession retrieves a session by token. Returns username and expiresAt.
+// Returns empty username if not found.
+func (s *MemoryStore) GetSession(token string) (username string, expiresAt int64, err error) {
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+
+	sess, ok := s.sessions[token]
+	if !ok {
+		return "", 0, nil
+	}
+	return sess.Username, sess.ExpiresAt, nil
+}
+
+// DeleteSession removes a session by token.
+func (s *MemoryStore) DeleteSession(token string) error {
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+
+	delete(s.sessions, token)
+	return nil
+}
+
+// DeleteUserSessions removes every session of username.
+func (s *MemoryStore) DeleteUserSessions(username string) error {
+	s.sessMu.Lock()
+	defer s.sessMu.Unlock()
+
+	for k, v := range s.sessions {
+		if strings.EqualFold(v.Username, username) {
+			delete(s.sessions, k)
+		}
+	}
+	return nil
+}
+
+// ---------- MFA tickets ----------
+
+// CreateMFATicket stores a ticket for a login that passed the password step.
+func (s *MemoryStore) CreateMFATicket(ticket, username string, expiresAt int64) error {
+	s.mfaMu.Lock()
+	defer s.mfaMu.Unlock()
+
+	s.mfaTickets[ticket] = &mfaTicket{
+		Username:  username,
+		ExpiresAt: expiresAt,
+	}
+	return nil
+}
+
+// UseMFATicket counts an attempt to redeem a ticket and returns its
+// username, or an empty username if the ticket is unknown, expired or used
+// up.
+func (s *MemoryStore) UseMFATicket(ticket string, maxAttempts int, now int64) (username string, err error) {
+	s.mfaMu.Lock()
+	defer s.mfaMu.Unlock()
+
+	t, ok := s.mfaTickets[ticket]
+	if !ok || t.Attempts >= maxAttempts || now > t.ExpiresAt {
+		return "", nil
+	}
+	t.Attempts++
+	return t.Username, nil
+}
+
+// DeleteMFATicket removes a ticket.
+func (s *MemoryStore) DeleteMFATicket(ticket string) error {
+	s.mfaMu.Lock()
+	defer s.mfaMu.Unlock()
+
+	delete(s.mfaTickets, ticket)
+	return nil
+}
+
+// ---------- TOTP enrollments ----------
+
+// CreateTOTPEnrollment stores a pending enrollment, replacing any earlier
+// one for the same session.
+func (s *MemoryStore) CreateTOTPEnrollment(sessionToken, username, secret string, createdAt, expiresAt int64) error {
+	s.enrollMu.Lock()
+	defer s.enrollMu.Unlock()
+
+	s.enrollments[sessionToken] = &totpEnrollment{
+		Username:  username,
+		Secret:    secret,
+		CreatedAt: createdAt,
+		ExpiresAt: expiresAt,
+	}
+	return nil
+}
+
+// GetTOTPEnrollment retrieves the pending enrollment of a session.
+// Returns empty username if not found.
+func (s *MemoryStore) GetTOTPEnrollment(sessionToken string) (username, secret string, expiresAt int64, err error) {
+	s.enrollMu.Lock()
+	defer s.enrollMu.Unlock()
+
+	e, ok := s.enrollments[sessionToken]
+	if !ok {
+		return "", "", 0, nil
+	}
+	return e.Username, e.Secret, e.ExpiresAt, nil
+}
+
+// DeleteTOTPEnrollment removes the pending enrollment of a session.
+func (s *MemoryStore) DeleteTOTPEnrollment(sessionToken string) error {
+	s.enrollMu.Lock()
+	defer s.enrollMu.Unlock()
+
+	delete(s.enrollments, sessionToken)
+	return nil
+}
+
+// ---------- Reset tokens ----------
+
+// CreateResetToken stores a new password reset token.
+func (s *MemoryStore) CreateResetToken(token, username string, expiresAt int64) error {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	s.resetTokens[token] = &resetTokenEntry{
+		Username:  username,
+		ExpiresAt: expiresAt,
+		Used:      false,
+	}
+	return nil
+}
+
+// GetResetToken retrieves a reset token. Returns username, expiresAt, used.
+// Returns empty username if not found.
+func (s *MemoryStore) GetResetToken(token string) (username string, expiresAt int64, used bool, err error) {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	rt, ok := s.resetTokens[token]
+	if !ok {
+		return "", 0, false, nil
+	}
+	return rt.Username, rt.ExpiresAt, rt.Used, nil
+}
+
+// MarkResetTokenUsed marks a reset token as used.
+func (s *MemoryStore) MarkResetTokenUsed(token string) error {
+	s.resetMu.Lock()
+	defer s.resetMu.Unlock()
+
+	if rt, ok := s.resetTokens[token]; ok {
+		rt.Used = true
+	}
+	return nil
+}
+
+// ---------- Pending signups ----------
+
+// CreatePendingSignup stores a new pending signup.
+func (s *MemoryStore) CreatePendingSignup(ps PendingSignup) error {
+	s.signupMu.Lock()
+	defer s.signupMu.Unlock()
+
+	s.signups[ps.ID] = ps
+	return nil
+}
+
+// GetPendingSignup retrieves a pending signup by id.
+// Returns an error if not found.
+func (s *MemoryStore) GetPendingSignup(id string) (*PendingSignup, error) {
+	s.signupMu.Lock()
+	defer s.signupMu.Unlock()
+
+	ps, ok := s.signups[id]
+	if !ok {
+		return nil, fmt.Errorf("signup not found")
+	}
+	return &ps, nil
+}
+
+// ListPendingSignups returns all pending signups, oldest first.
+func (s *MemoryStore) ListPendingSignups() ([]PendingSignup, error) {
+	s.signupMu.Lock()
+	defer s.signupMu.Unlock()
+
+	res := make([]PendingSignup, 0, len(s.signups))
+	for _, ps := range s.signups {
+		res = append(res, ps)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		if res[i].CreatedAt != res[j].CreatedAt {
+			return res[i].CreatedAt < res[j].CreatedAt
+		}
+		return res[i].ID < res[j].ID
+	})
+	return res, nil
+}
+
+// MarkPendingSignupVerified records a confirmed email and the new expiry.
+func (s *MemoryStore) MarkPendingSignupVerified(id string, expiresAt int64) error {
+	s.signupMu.Lock()
+	defer s.signupMu.Unlock()
+
+	ps, ok := s.signups[id]
+	if !ok {
+		return fmt.Errorf("signup not found")
+	}
+	ps.EmailVerified = true
+	ps.ExpiresAt = expiresAt
+	s.signups[id] = ps
+	return nil
+}
+
+// DeletePendingSignup removes a pending signup by id.
+func (s *MemoryStore) DeletePendingSignup(id string) error {
+	s.signupMu.Lock()
+	defer s.signupMu.Unlock()
+
+	if _, ok := s.signups[id]; !ok {
+		return fmt.Errorf("signup not found")
+	}
+	delete(s.signups, id)
+	return nil
+}
+
+// ---------- SMS reset codes ----------
+
+// StoreSMSResetCode stores a reset code for SMS-based password reset.
+func (s *MemoryStore) StoreSMSResetCode(id, username, code string, expiresAt int64) error {
+	s.smsMu.Lock()
+	defer s.smsMu.Unlock()
+
+	s.smsCodes[id] = &smsResetCode{
+		Username:  username,
+		Code:      code,
+		ExpiresAt: expiresAt,
+		Used:      false,
+	}
+	return nil
+}
+
+// VerifySMSResetCode checks code against the most recent unused code for
+// username. Wrong guesses count against that code, which is burned after
+// maxAttempts failures.
+func (s *MemoryStore) VerifySMSResetCode(username, code string, maxAttempts int) error {
+	s.smsMu.Lock()
+	defer s.smsMu.Unlock()
+
+	// Find the most recent unused code for this user
+	var sc *smsResetCode
+	for _, c := range s.smsCodes {
+		if c.Username == username && !c.Used && (sc == nil || c.ExpiresAt > sc.ExpiresAt) {
+			sc = c
+		}
+	}
+
+	if sc == nil {
+		return fmt.Errorf("invalid code")
+	}
+	if time.Now().Unix() > sc.ExpiresAt {
+		return fmt.Errorf("code expired")
+	}
+	if subtle.ConstantTimeCompare([]byte(sc.Code), []byte(code)) != 1 {
+		sc.Attempts++
+		if sc.Attempts >= maxAttempts {
+			sc.Used = true
+		}
+		return fmt.Errorf("invalid code")
+	}
+
+	sc.Used = true
+	return nil
+}
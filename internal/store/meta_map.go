@@ -0,0 +1,221 @@
+package store
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// metaMap is an in-memory UserMetaStore. When save is set it is called
+// with the lock held after every mutation so the map can be persisted.
+// Mutations notify the OnUserMetaWrite callbacks once the lock is released.
+type metaMap struct {
+	metaHooks
+
+	mu     sync.RWMutex
+	users  map[string]*UserMeta // key = email/username
+	phones map[string][]string  // phone -> sorted usernames
+	save   func(users map[string]*UserMeta) error
+}
+
+func newMetaMap(save func(users map[string]*UserMeta) error) *metaMap {
+	m := &metaMap{save: save}
+	m.setUsers(make(map[string]*UserMeta))
+	return m
+}
+
+// setUsers replaces all metadata and rebuilds the phone index.
+func (m *metaMap) setUsers(users map[string]*UserMeta) {
+	m.users = users
+	m.phones = make(map[string][]string)
+	for username, meta := range users {
+		m.indexPhone(username, "", meta.Phone)
+	}
+}
+
+// indexPhone moves username from old to phone in the phone index.
+func (m *metaMap) indexPhone(username, old, phone string) {
+	if old == phone {
+		return
+	}
+	if names := m.phones[old]; old != "" {
+		i := sort.SearchStrings(names, username)
+		if i < len(names) && names[i] == username {
+			names = append(names[:i:i], names[i+1:]...)
+		}
+		if len(names) == 0 {
+			delete(m.phones, old)
+		} else {
+			m.phones[old] = names
+		}
+	}
+	if phone != "" {
+		names := append(m.phones[phone], username)
+		sort.Strings(names)
+		m.phones[phone] = names
+	}
+}
+
+// checkPhone returns ErrPhoneTaken if meta verifies a number for username
+// that is the verified number of another user.
+func (m *metaMap) checkPhone(username string, meta *UserMeta) error {
+	if meta.Phone == "" || meta.PhoneVerifiedAt == 0 {
+		return nil
+	}
+	for _, other := range m.verifiedOwners(meta.Phone) {
+		if other != username {
+			return ErrPhoneTaken
+		}
+	}
+	return nil
+}
+
+// verifiedOwners returns the users whose verified number phone is.
+func (m *metaMap) verifiedOwners(phone string) []string {
+	var res []string
+	for _, username := range m.phones[phone] {
+		if m.users[username].PhoneVerifiedAt > 0 {
+			res = append(res, username)
+		}
+	}
+	return res
+}
+
+func (m *metaMap) persist() error {
+	if m.save == nil {
+		return nil
+	}
+	return m.save(m.users)
+}
+
+// SetPhone sets an unverified phone number for a user.
+func (m *metaMap) SetPhone(username, phone string) error {
+	defer m.notifyMetaWrite()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta, ok := m.users[username]
+	if !ok {
+		meta = &UserMeta{}
+	}
+	m.indexPhone(username, meta.Phone, phone)
+	if meta.Phone != phone {
+		meta.Phone, meta.PhoneVerifiedAt = phone, 0
+	}
+	m.users[username] = meta
+	return m.persist()
+}
+
+// GetPhone retrieves the phone number for a user.
+func (m *metaMap) GetPhone(username string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	meta, ok := m.users[username]
+	if !ok {
+		return "", nil
+	}
+	return meta.Phone, nil
+}
+
+// FindUserByPhone returns the user whose verified number phone is.
+func (m *metaMap) FindUserByPhone(phone string) (string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	switch names := m.verifiedOwners(phone); len(names) {
+	case 0:
+		return "", nil
+	case 1:
+		return names[0], nil
+	default:
+		log.Printf("[store] phone number %s is set for %d users, ignoring it", phone, len(names))
+		return "", nil
+	}
+}
+
+// FindUsersByEmail returns the users with the given email, sorted.
+func (m *metaMap) FindUsersByEmail(email string) ([]string, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var res []string
+	for username, meta := range m.users {
+		if meta.Email != "" && strings.EqualFold(meta.Email, email) {
+			res = append(res, username)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// GetUserMeta returns the metadata for a user (or nil if not found).
+func (m *metaMap) GetUserMeta(username string) *UserMeta {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	if meta, ok := m.users[username]; ok {
+		return meta.clone()
+	}
+	return nil
+}
+
+// SetUserMeta sets/replaces the metadata for a user.
+func (m *metaMap) SetUserMeta(username string, meta *UserMeta) error {
+	defer m.notifyMetaWrite()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var old string
+	if cur, ok := m.users[username]; ok {
+		old = cur.Phone
+	}
+	if err := m.checkPhone(username, meta); err != nil {
+		return err
+	}
+	m.indexPhone(username, old, meta.Phone)
+	m.users[username] = meta.clone()
+	return m.persist()
+}
+
+// ListUserMeta returns a copy of the metadata for all users.
+func (m *metaMap) ListUserMeta() map[string]UserMeta {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	res := make(map[string]UserMeta, len(m.users))
+	for username, meta := range m.users {
+		res[username] = *meta.clone()
+	}
+	return res
+}
+
+// DeleteUserMeta removes the metadata for a user.
+func (m *metaMap) DeleteUserMeta(username string) error {
+	defer m.notifyMetaWrite()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	meta, ok := m.users[username]
+	if !ok {
+		return nil
+	}
+	m.indexPhone(username, meta.Phone, "")
+	delete(m.users, username)
+	return m.persist()
+}
+
+// ReplaceUserMeta swaps the metadata of all users for all at once.
+func (m *metaMap) ReplaceUserMeta(all map[string]UserMeta) error {
+	defer m.notifyMetaWrite()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	users := make(map[string]*UserMeta, len(all))
+	for username, meta := range all {
+		users[username] = meta.clone()
+	}
+	m.setUsers(users)
+	return m.persist()
+}
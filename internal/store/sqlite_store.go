@@ -0,0 +1,262 @@
+package store
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+)
+
+// SQLiteStore keeps everything, including user metadata, in one SQLite
+// database. Several instances can share the same database file.
+type SQLiteStore struct {
+	*sqlState
+	metaHooks
+}
+
+// NewSQLiteStore opens and migrates the database at dbPath. If the
+// database has no user metadata yet and importTOMLPath exists, its
+// contents are imported once so switching backends keeps roles and phones.
+func NewSQLiteStore(dbPath, importTOMLPath string) (*SQLiteStore, error) {
+	db, err := openDB(dbPath)
+	if err != nil {
+		return nil, err
+	}
+	s := &SQLiteStore{sqlState: &sqlState{db: db}}
+	if importTOMLPath != "" {
+		if err := s.importTOML(importTOMLPath); err != nil {
+			db.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Close closes the database.
+func (s *SQLiteStore) Close() error { return s.db.Close() }
+
+func (s *SQLiteStore) importTOML(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return nil
+	}
+	var n int
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM user_meta`).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+	users, err := readTOML(path)
+	if err != nil {
+		return err
+	}
+	all := make(map[string]UserMeta, len(users))
+	for username, meta := range users {
+		all[username] = *meta
+	}
+	if err := s.ReplaceUserMeta(all); err != nil {
+		return fmt.Errorf("import %s: %w", path, err)
+	}
+	log.Printf("[store] imported %d user(s) from %s", len(users), path)
+	return nil
+}
+
+// ---------- User metadata ----------
+
+// SetPhone sets an unverified phone number for a user.
+func (s *SQLiteStore) SetPhone(username, phone string) error {
+	meta := s.GetUserMeta(username)
+	if meta == nil {
+		meta = &UserMeta{}
+	}
+	if meta.Phone != phone {
+		meta.Phone, meta.PhoneVerifiedAt = phone, 0
+	}
+	return s.SetUserMeta(username, meta)
+}
+
+// GetPhone retrieves the phone number for a user.
+func (s *SQLiteStore) GetPhone(username string) (string, error) {
+	var phone string
+	err := s.db.QueryRow(`SELECT phone FROM user_meta WHERE username = ?`, username).Scan(&phone)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return phone, err
+}
+
+// FindUserByPhone returns the user whose verified number phone is.
+func (s *SQLiteStore) FindUserByPhone(phone string) (string, error) {
+	if phone == "" {
+		return "", nil
+	}
+	names, err := verifiedPhoneOwners(s.db, phone)
+	if err != nil {
+		return "", err
+	}
+	switch len(names) {
+	case 0:
+		return "", nil
+	case 1:
+		return names[0], nil
+	default:
+		log.Printf("[store] phone number %s is set for several users, ignoring it", phone)
+		return "", nil
+	}
+}
+
+// verifiedPhoneOwners returns the users whose verified number phone is.
+// Whether a number is verified is only kept in the data column.
+func verifiedPhoneOwners(q interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}, phone string) ([]string, error) {
+	rows, err := q.Query(`SELECT username, data FROM user_meta WHERE phone = ?`, phone)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var names []string
+	for rows.Next() {
+		var username, data string
+		if err := rows.Scan(&username, &data); err != nil {
+			return nil, err
+		}
+		var meta UserMeta
+		if err := json.Unmarshal([]byte(data), &meta); err != nil {
+			return nil, fmt.Errorf("decode user meta %s: %w", username, err)
+		}
+		if meta.PhoneVerifiedAt > 0 {
+			names = append(names, username)
+		}
+	}
+	return names, rows.Err()
+}
+
+// FindUsersByEmail returns the users with the given email, sorted.
+func (s *SQLiteStore) FindUsersByEmail(email string) ([]string, error) {
+	email = strings.ToLower(email)
+	if email == "" {
+		return nil, nil
+	}
+	rows, err := s.db.Query(`SELECT username FROM user_meta WHERE email = ? ORDER BY username`, email)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var res []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		res = append(res, username)
+	}
+	return res, rows.Err()
+}
+
+// GetUserMeta returns the metadata for a user (or nil if not found).
+func (s *SQLiteStore) GetUserMeta(username string) *UserMeta {
+	var data string
+	if err := s.db.QueryRow(`SELECT data FROM user_meta WHERE username = ?`, username).Scan(&data); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			log.Printf("[store] get user meta %s: %v", username, err)
+		}
+		return nil
+	}
+	var meta UserMeta
+	if err := json.Unmarshal([]byte(data), &meta); err != nil {
+		log.Printf("[store] decode user meta %s: %v", username, err)
+		return nil
+	}
+	return &meta
+}
+
+// SetUserMeta sets/replaces the metadata for a user.
+func (s *SQLiteStore) SetUserMeta(username string, meta *UserMeta) error {
+	defer s.notifyMetaWrite()
+	data, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if meta.Phone != "" && meta.PhoneVerifiedAt > 0 {
+		owners, err := verifiedPhoneOwners(tx, meta.Phone)
+		if err != nil {
+			return err
+		}
+		for _, other := range owners {
+			if other != username {
+				return ErrPhoneTaken
+			}
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO user_meta (username, phone, email, data) VALUES (?, ?, ?, ?)
+		ON CONFLICT(username) DO UPDATE SET phone = excluded.phone, email = excluded.email, data = excluded.data`,
+		username, meta.Phone, strings.ToLower(meta.Email), string(data)); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// ListUserMeta returns a copy of the metadata for all users.
+func (s *SQLiteStore) ListUserMeta() map[string]UserMeta {
+	res := make(map[string]UserMeta)
+	rows, err := s.db.Query(`SELECT username, data FROM user_meta`)
+	if err != nil {
+		log.Printf("[store] list user meta: %v", err)
+		return res
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var username, data string
+		if err := rows.Scan(&username, &data); err != nil {
+			log.Printf("[store] list user meta: %v", err)
+			continue
+		}
+		var meta UserMeta
+		if err := json.Unmarshal([]byte(data), &meta); err != nil {
+			log.Printf("[store] decode user meta %s: %v", username, err)
+			continue
+		}
+		res[username] = meta
+	}
+	return res
+}
+
+// DeleteUserMeta removes the metadata for a user.
+func (s *SQLiteStore) DeleteUserMeta(username string) error {
+	defer s.notifyMetaWrite()
+	_, err := s.db.Exec(`DELETE FROM user_meta WHERE username = ?`, username)
+	return err
+}
+
+// ReplaceUserMeta swaps the metadata of all users for all at once.
+func (s *SQLiteStore) ReplaceUserMeta(all map[string]UserMeta) error {
+	defer s.notifyMetaWrite()
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM user_meta`); err != nil {
+		return err
+	}
+	for username, meta := range all {
+		data, err := json.Marshal(meta)
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO user_meta (username, phone, email, data) VALUES (?, ?, ?, ?)`,
+			username, meta.Phone, strings.ToLower(meta.Email), string(data)); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,444 @@
+package store
+
+import (
+	"context"
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "modernc.org/sqlite"
+)
+
+// migrations are applied in order on startup. The index+1 of each entry is
+// stored in PRAGMA user_version, so entries must never be edited or
+// reordered once released — only appended.
+var migrations = []string{
+	`CREATE TABLE sessions (
+		token      TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		created_at INTEGER NOT NULL,
+		expires_at INTEGER NOT NULL
+	);
+	CREATE TABLE mfa_tickets (
+		ticket     TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		attempts   INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE reset_tokens (
+		token      TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		used       INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE pending_signups (
+		id            TEXT PRIMARY KEY,
+		username      TEXT NOT NULL,
+		email         TEXT NOT NULL,
+		password_hash TEXT NOT NULL,
+		created_at    INTEGER NOT NULL,
+		approved      INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE TABLE sms_reset_codes (
+		id         TEXT PRIMARY KEY,
+		username   TEXT NOT NULL,
+		code       TEXT NOT NULL,
+		expires_at INTEGER NOT NULL,
+		used       INTEGER NOT NULL DEFAULT 0
+	);
+	CREATE INDEX idx_sms_reset_codes_username ON sms_reset_codes(username);`,
+	`CREATE TABLE user_meta (
+		username TEXT PRIMARY KEY,
+		phone    TEXT NOT NULL DEFAULT '',
+		data     TEXT NOT NULL
+	);
+	CREATE INDEX idx_user_meta_phone ON user_meta(phone);`,
+	`CREATE TABLE totp_enrollments (
+		session_token TEXT PRIMARY KEY,
+		username      TEXT NOT NULL,
+		secret        TEXT NOT NULL,
+		created_at    INTEGER NOT NULL,
+		expires_at    INTEGER NOT NULL
+	);`,
+	`ALTER TABLE sms_reset_codes ADD COLUMN attempts INTEGER NOT NULL DEFAULT 0;`,
+	// Approved signups used to be kept; they are deleted on approval now.
+	`ALTER TABLE pending_signups ADD COLUMN phone TEXT NOT NULL DEFAULT '';
+	ALTER TABLE pending_signups ADD COLUMN expires_at INTEGER NOT NULL DEFAULT 0;
+	DELETE FROM pending_signups WHERE approved = 1;`,
+	// Signups made before email verification existed count as verified.
+	`ALTER TABLE pending_signups ADD COLUMN email_verified INTEGER NOT NULL DEFAULT 1;`,
+	// email holds the lowercased UserMeta.Email for lookups.
+	`ALTER TABLE user_meta ADD COLUMN email TEXT NOT NULL DEFAULT '';
+	CREATE INDEX idx_user_meta_email ON user_meta(email);`,
+}
+
+// sqlState implements the short-lived parts of Store (sessions, MFA
+// tickets, reset tokens, signups, SMS codes) on top of SQLite.
+type sqlState struct {
+	db *sql.DB
+}
+
+// openDB opens the SQLite database at path and brings its schema up to date.
+func openDB(path string) (*sql.DB, error) {
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return nil, fmt.Errorf("mkdir db dir: %w", err)
+	}
+	dsn := "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)"
+	db, err := sql.Open("sqlite", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open db: %w", err)
+	}
+	// A single connection serialises writers and avoids SQLITE_BUSY.
+	db.SetMaxOpenConns(1)
+	if err := migrate(db); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func migrate(db *sql.DB) error {
+	var version int
+	if err := db.QueryRow(`PRAGMA user_version`).Scan(&version); err != nil {
+		return fmt.Errorf("read schema version: %w", err)
+	}
+	if version > len(migrations) {
+		return fmt.Errorf("db schema version %d is newer than supported %d", version, len(migrations))
+	}
+	for i := version; i < len(migrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(migrations[i]); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if _, err := tx.Exec(fmt.Sprintf(`PRAGMA user_version = %d`, i+1)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("migration %d: %w", i+1, err)
+		}
+		log.Printf("[store] applied migration %d", i+1)
+	}
+	return nil
+}
+
+// PurgeExpired deletes every session, ticket, enrollment, token, code and
+// signup that expired before now. It returns the number of rows removed.
+func (s *sqlState) PurgeExpired(now int64) (int64, error) {
+	var total int64
+	for _, table := range []string{"sessions", "mfa_tickets", "totp_enrollments", "reset_tokens", "sms_reset_codes"} {
+		res, err := s.db.Exec(`DELETE FROM `+table+` WHERE expires_at < ?`, now)
+		if err != nil {
+			return total, fmt.Errorf("purge %s: %w", table, err)
+		}
+		n, _ := res.RowsAffected()
+		total += n
+	}
+	res, err := s.db.Exec(`DELETE FROM pending_signups WHERE expires_at > 0 AND expires_at < ?`, now)
+	if err != nil {
+		return total, fmt.Errorf("purge pending_signups: %w", err)
+	}
+	n, _ := res.RowsAffected()
+	return total + n, nil
+}
+
+// DeleteUserTokens removes everything issued to username.
+func (s *sqlState) DeleteUserTokens(username string) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, table := range []string{"sessions", "mfa_tickets", "totp_enrollments", "reset_tokens", "sms_reset_codes"} {
+		if _, err := tx.Exec(`DELETE FROM `+table+` WHERE username = ? COLLATE NOCASE`, username); err != nil {
+			return fmt.Errorf("delete %s: %w", table, err)
+		}
+	}
+	return tx.Commit()
+}
+
+// ---------- Sessions ----------
+
+// CreateSession stores a new session token.
+func (s *sqlState) CreateSession(token, username string, createdAt, expiresAt int64) error {
+	_, err := s.db.Exec(`INSERT INTO sessions (token, username, created_at, expires_at) VALUES (?, ?, ?, ?)`,
+		token, username, createdAt, expiresAt)
+	return err
+}
+
+// GetSession retrieves a session by token. Returns username and expiresAt.
+// Returns empty username if not found.
+func (s *sqlState) GetSession(token string) (username string, expiresAt int64, err error) {
+	err = s.db.QueryRow(`SELECT username, expires_at FROM sessions WHERE token = ?`, token).Scan(&username, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, nil
+	}
+	return username, expiresAt, err
+}
+
+// DeleteSession removes a session by token.
+func (s *sqlState) DeleteSession(token string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE token = ?`, token)
+	return err
+}
+
+// DeleteUserSessions removes every session of username.
+func (s *sqlState) DeleteUserSessions(username string) error {
+	_, err := s.db.Exec(`DELETE FROM sessions WHERE username = ? COLLATE NOCASE`, username)
+	return err
+}
+
+// ---------- MFA tickets ----------
+
+// CreateMFATicket stores a ticket for a login that passed the password step.
+func (s *sqlState) CreateMFATicket(ticket, username string, expiresAt int64) error {
+	_, err := s.db.Exec(`INSERT INTO mfa_tickets (ticket, username, expires_at) VALUES (?, ?, ?)`,
+		ticket, username, expiresAt)
+	return err
+}
+
+// UseMFATicket counts an attempt to redeem a ticket and returns its
+// username, or an empty username if the ticket is unknown, expired or used
+// up.
+func (s *sqlState) UseMFATicket(ticket string, maxAttempts int, now int64) (username string, err error) {
+	err = s.db.QueryRow(`UPDATE mfa_tickets SET attempts = attempts + 1
+		WHERE ticket = ? AND attempts < ? AND expires_at >= ? RETURNING username`, ticket, maxAttempts, now).
+		Scan(&username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return username, err
+}
+
+// DeleteMFATicket removes a ticket.
+func (s *sqlState) DeleteMFATicket(ticket string) error {
+	_, err := s.db.Exec(`DELETE FROM mfa_tickets WHERE ticket = ?`, ticket)
+	return err
+}
+
+// ---------- TOTP enrollments ----------
+
+// CreateTOTPEnrollment stores a pending enrollment, replacing any earlier
+// one for the same session.
+func (s *sqlState) CreateTOTPEnrollment(sessionToken, username, secret string, createdAt, expiresAt int64) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO totp_enrollments (session_token, username, secret, created_at, expires_at)
+		VALUES (?, ?, ?, ?, ?)`, sessionToken, username, secret, createdAt, expiresAt)
+	return err
+}
+
+// GetTOTPEnrollment retrieves the pending enrollment of a session.
+// Returns empty username if not found.
+func (s *sqlState) GetTOTPEnrollment(sessionToken string) (username, secret string, expiresAt int64, err error) {
+	err = s.db.QueryRow(`SELECT username, secret, expires_at FROM totp_enrollments WHERE session_token = ?`, sessionToken).
+		Scan(&username, &secret, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", "", 0, nil
+	}
+	return username, secret, expiresAt, err
+}
+
+// DeleteTOTPEnrollment removes the pending enrollment of a session.
+func (s *sqlState) DeleteTOTPEnrollment(sessionToken string) error {
+	_, err := s.db.Exec(`DELETE FROM totp_enrollments WHERE session_token = ?`, sessionToken)
+	return err
+}
+
+// ---------- Reset tokens ----------
+
+// CreateResetToken stores a new password reset token.
+func (s *sqlState) CreateResetToken(token, username string, expiresAt int64) error {
+	_, err := s.db.Exec(`INSERT INTO reset_tokens (token, username, expires_at) VALUES (?, ?, ?)`,
+		token, username, expiresAt)
+	return err
+}
+
+// GetResetToken retrieves a reset token. Returns username, expiresAt, used.
+// Returns empty username if not found.
+func (s *sqlState) GetResetToken(token string) (username string, expiresAt int64, used bool, err error) {
+	err = s.db.QueryRow(`SELECT username, expires_at, used FROM reset_tokens WHERE token = ?`, token).
+		Scan(&username, &expiresAt, &used)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", 0, false, nil
+	}
+	return username, expiresAt, used, err
+}
+
+// MarkResetTokenUsed marks a reset token as used.
+func (s *sqlState) MarkResetTokenUsed(token string) error {
+	_, err := s.db.Exec(`UPDATE reset_tokens SET used = 1 WHERE token = ?`, token)
+	return err
+}
+
+// ---------- Pending signups ----------
+
+const signupColumns = `id, username, email, phone, password_hash, email_verified, created_at, expires_at`
+
+// CreatePendingSignup stores a new pending signup.
+func (s *sqlState) CreatePendingSignup(ps PendingSignup) error {
+	_, err := s.db.Exec(`INSERT INTO pending_signups (`+signupColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?)`,
+		ps.ID, ps.Username, ps.Email, ps.Phone, ps.PasswordHash, ps.EmailVerified, ps.CreatedAt, ps.ExpiresAt)
+	return err
+}
+
+// GetPendingSignup retrieves a pending signup by id.
+func (s *sqlState) GetPendingSignup(id string) (*PendingSignup, error) {
+	var ps PendingSignup
+	err := s.db.QueryRow(`SELECT `+signupColumns+` FROM pending_signups WHERE id = ?`, id).
+		Scan(&ps.ID, &ps.Username, &ps.Email, &ps.Phone, &ps.PasswordHash, &ps.EmailVerified, &ps.CreatedAt, &ps.ExpiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, fmt.Errorf("signup not found")
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ps, nil
+}
+
+// ListPendingSignups returns all pending signups, oldest first.
+func (s *sqlState) ListPendingSignups() ([]PendingSignup, error) {
+	rows, err := s.db.Query(`SELECT ` + signupColumns + ` FROM pending_signups ORDER BY created_at, id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	res := []PendingSignup{}
+	for rows.Next() {
+		var ps PendingSignup
+		if err := rows.Scan(&ps.ID, &ps.Username, &ps.Email, &ps.Phone, &ps.PasswordHash, &ps.EmailVerified, &ps.CreatedAt, &ps.ExpiresAt); err != nil {
+			return nil, err
+		}
+		res = append(res, ps)
+	}
+	return res, rows.Err()
+}
+
+// MarkPendingSignupVerified records a confirmed email and the new expiry.
+func (s *sqlState) MarkPendingSignupVerified(id string, expiresAt int64) error {
+	res, err := s.db.Exec(`UPDATE pending_signups SET email_verified = 1, expires_at = ? WHERE id = ?`, expiresAt, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("signup not found")
+	}
+	return nil
+}
+
+// DeletePendingSignup removes a pending signup by id.
+func (s *sqlState) DeletePendingSignup(id string) error {
+	res, err := s.db.Exec(`DELETE FROM pending_signups WHERE id = ?`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("signup not found")
+	}
+	return nil
+}
+
+// ---------- SMS reset codes ----------
+
+// StoreSMSResetCode stores a reset code for SMS-based password reset.
+func (s *sqlState) StoreSMSResetCode(id, username, code string, expiresAt int64) error {
+	_, err := s.db.Exec(`INSERT INTO sms_reset_codes (id, username, code, expires_at) VALUES (?, ?, ?, ?)`,
+		id, username, code, expiresAt)
+	return err
+}
+
+// VerifySMSResetCode checks code against the most recent unused code for
+// username. Wrong guesses count against that code, which is burned after
+// maxAttempts failures.
+func (s *sqlState) VerifySMSResetCode(username, code string, maxAttempts int) error {
+	var (
+		id        string
+		stored    string
+		expiresAt int64
+	)
+	err := s.db.QueryRow(`SELECT id, code, expires_at FROM sms_reset_codes
+		WHERE username = ? AND used = 0 ORDER BY expires_at DESC LIMIT 1`, username).
+		Scan(&id, &stored, &expiresAt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("invalid code")
+	}
+	if err != nil {
+		return err
+	}
+	if time.Now().Unix() > expiresAt {
+		return fmt.Errorf("code expired")
+	}
+
+	if subtle.ConstantTimeCompare([]byte(stored), []byte(code)) != 1 {
+		if _, err := s.db.Exec(`UPDATE sms_reset_codes SET attempts = attempts + 1,
+			used = CASE WHEN attempts + 1 >= ? THEN 1 ELSE used END WHERE id = ?`, maxAttempts, id); err != nil {
+			return err
+		}
+		return fmt.Errorf("invalid code")
+	}
+
+	// Guard against a concurrent verification of the same code.
+	res, err := s.db.Exec(`UPDATE sms_reset_codes SET used = 1 WHERE id = ? AND used = 0`, id)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return fmt.Errorf("code already used")
+	}
+	return nil
+}
+
+// ---------- Backup ----------
+
+// stateTables are the tables copied by RestoreState. user_meta is left
+// alone; metadata is restored through ReplaceUserMeta.
+var stateTables = []string{"sessions", "mfa_tickets", "totp_enrollments", "reset_tokens", "pending_signups", "sms_reset_codes"}
+
+// BackupState writes a consistent copy of the database to path.
+func (s *sqlState) BackupState(path string) error {
+	_, err := s.db.Exec(`VACUUM INTO ?`, path)
+	return err
+}
+
+// RestoreState replaces the state tables with those of the database at
+// path in a single transaction.
+func (s *sqlState) RestoreState(path string) error {
+	src, err := openDB(path)
+	if err != nil {
+		return fmt.Errorf("backup database: %w", err)
+	}
+	src.Close()
+
+	ctx := context.Background()
+	conn, err := s.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if _, err := conn.ExecContext(ctx, `ATTACH DATABASE ? AS src`, path); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, `DETACH DATABASE src`)
+
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	for _, t := range stateTables {
+		if _, err := tx.Exec(`DELETE FROM main.` + t); err != nil {
+			return fmt.Errorf("restore %s: %w", t, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO main.` + t + ` SELECT * FROM src.` + t); err != nil {
+			return fmt.Errorf("restore %s: %w", t, err)
+		}
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,291 @@
+package store
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// Roles recognised in UserMeta.Role. An empty role is treated as RoleUser.
+const (
+	RoleAdmin = "admin"
+	RoleUser  = "user"
+)
+
+// ErrPhoneTaken is returned when a phone number is already the verified
+// number of another user.
+var ErrPhoneTaken = errors.New("phone number already in use")
+
+// Backends selectable through Open.
+const (
+	BackendTOML   = "toml"   // users.toml for metadata, SQLite file for the rest
+	BackendSQLite = "sqlite" // everything in one SQLite database
+	BackendMemory = "memory" // nothing survives a restart; meant for tests
+)
+
+// UserMeta holds persistent per-user metadata.
+type UserMeta struct {
+	Name     string `toml:"name,omitempty" json:"name,omitempty"`
+	Role     string `toml:"role,omitempty" json:"role,omitempty"`
+	Phone    string `toml:"phone,omitempty" json:"phone,omitempty"`
+	Approved bool   `toml:"approved,omitempty" json:"approved,omitempty"`
+	// PhoneVerifiedAt is the unix time Phone was confirmed with a code sent
+	// to it, or 0 if it never was. Only verified numbers receive SMS
+	// password reset codes.
+	PhoneVerifiedAt int64 `toml:"phone_verified_at,omitempty" json:"phone_verified_at,omitempty"`
+	// PendingPhone is a number the user asked to change to and has not
+	// confirmed yet. PendingPhoneAt is the unix time the code was sent,
+	// PendingPhoneCode a keyed hash of that code and PendingPhoneAttempts
+	// the wrong guesses so far.
+	PendingPhone         string `toml:"pending_phone,omitempty" json:"pending_phone,omitempty"`
+	PendingPhoneAt       int64  `toml:"pending_phone_at,omitempty" json:"pending_phone_at,omitempty"`
+	PendingPhoneCode     string `toml:"pending_phone_code,omitempty" json:"pending_phone_code,omitempty"`
+	PendingPhoneAttempts int    `toml:"pending_phone_attempts,omitempty" json:"pending_phone_attempts,omitempty"`
+	// Email receives password reset links. It is only ever set by an
+	// admin, at signup or after the user confirmed PendingEmail.
+	Email string `toml:"email,omitempty" json:"email,omitempty"`
+	// EmailVerifiedAt is the unix time Email was confirmed through a link,
+	// or 0 if it never was.
+	EmailVerifiedAt int64 `toml:"email_verified_at,omitempty" json:"email_verified_at,omitempty"`
+	// PendingEmail is an address the user asked to change to and has not
+	// confirmed yet; PendingEmailAt is the unix time they asked.
+	PendingEmail   string `toml:"pending_email,omitempty" json:"pending_email,omitempty"`
+	PendingEmailAt int64  `toml:"pending_email_at,omitempty" json:"pending_email_at,omitempty"`
+	// TOTPEnrolledAt is the unix time TOTP was last enrolled.
+	TOTPEnrolledAt int64 `toml:"totp_enrolled_at,omitempty" json:"totp_enrolled_at,omitempty"`
+	// RecoveryCodes holds SHA-256 hashes of the unused TOTP recovery codes.
+	RecoveryCodes []string `toml:"recovery_codes,omitempty" json:"recovery_codes,omitempty"`
+}
+
+// clone returns a deep copy of m.
+func (m *UserMeta) clone() *UserMeta {
+	cp := *m
+	cp.RecoveryCodes = append([]string(nil), m.RecoveryCodes...)
+	return &cp
+}
+
+// RoleOf returns the effective role for meta. Users without metadata or
+// without an explicit role get RoleUser.
+func RoleOf(meta *UserMeta) string {
+	if meta == nil || meta.Role == "" {
+		return RoleUser
+	}
+	return meta.Role
+}
+
+// UserMetaStore keeps per-user metadata, keyed by username.
+//
+// A verified phone number (PhoneVerifiedAt set) belongs to at most one
+// user: SetUserMeta fails with ErrPhoneTaken when it would verify a number
+// for a user that is the verified number of another. Unverified numbers
+// may be shared, so nobody can claim the number of someone else just by
+// entering it. ReplaceUserMeta restores metadata as it is and does not
+// check this.
+type UserMetaStore interface {
+	// SetPhone sets an unverified phone number for a user.
+	SetPhone(username, phone string) error
+	GetPhone(username string) (string, error)
+	// FindUserByPhone returns the user whose verified number phone is, or
+	// "" if none. Numbers verified for several users, which older versions
+	// allowed, match nobody.
+	FindUserByPhone(phone string) (string, error)
+	// FindUsersByEmail returns the users whose Email matches email,
+	// ignoring case.
+	FindUsersByEmail(email string) ([]string, error)
+	// GetUserMeta returns a copy of the metadata for a user, or nil if not found.
+	GetUserMeta(username string) *UserMeta
+	SetUserMeta(username string, meta *UserMeta) error
+	ListUserMeta() map[string]UserMeta
+	DeleteUserMeta(username string) error
+	// ReplaceUserMeta swaps the metadata of all users for all at once.
+	ReplaceUserMeta(all map[string]UserMeta) error
+	// OnUserMetaWrite registers fn to be called after every metadata
+	// write by this process. It runs with no lock held.
+	OnUserMetaWrite(fn func())
+}
+
+// metaHooks holds the OnUserMetaWrite callbacks of a store.
+type metaHooks struct {
+	mu  sync.Mutex
+	fns []func()
+}
+
+func (h *metaHooks) OnUserMetaWrite(fn func()) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.fns = append(h.fns, fn)
+}
+
+func (h *metaHooks) notifyMetaWrite() {
+	h.mu.Lock()
+	fns := append([]func(){}, h.fns...)
+	h.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// SessionStore keeps management UI sessions and pending MFA tickets.
+type SessionStore interface {
+	CreateSession(token, username string, createdAt, expiresAt int64) error
+	// GetSession returns username and expiresAt, or an empty username if not found.
+	GetSession(token string) (username string, expiresAt int64, err error)
+	DeleteSession(token string) error
+	// DeleteUserSessions removes every session of username, ignoring case
+	// like the users file does.
+	DeleteUserSessions(username string) error
+
+	CreateMFATicket(ticket, username string, expiresAt int64) error
+	// UseMFATicket counts an attempt to redeem a ticket and returns its
+	// username, or an empty username if the ticket is unknown, expired at
+	// now or already had maxAttempts attempts. Counting and checking are
+	// one step, so concurrent attempts cannot exceed maxAttempts.
+	UseMFATicket(ticket string, maxAttempts int, now int64) (username string, err error)
+	DeleteMFATicket(ticket string) error
+}
+
+// TOTPEnrollmentStore keeps TOTP secrets that were generated for a
+// session but not yet confirmed with a code. There is at most one pending
+// enrollment per session.
+type TOTPEnrollmentStore interface {
+	CreateTOTPEnrollment(sessionToken, username, secret string, createdAt, expiresAt int64) error
+	// GetTOTPEnrollment returns username, secret and expiresAt, or an empty
+	// username if not found.
+	GetTOTPEnrollment(sessionToken string) (username, secret string, expiresAt int64, err error)
+	DeleteTOTPEnrollment(sessionToken string) error
+}
+
+// ResetTokenStore keeps emailed password reset tokens.
+type ResetTokenStore interface {
+	CreateResetToken(token, username string, expiresAt int64) error
+	// GetResetToken returns username, expiresAt and used, or an empty
+	// username if not found.
+	GetResetToken(token string) (username string, expiresAt int64, used bool, err error)
+	MarkResetTokenUsed(token string) error
+}
+
+// PendingSignup is a signup waiting for an admin decision.
+type PendingSignup struct {
+	ID           string `json:"id"`
+	Username     string `json:"username"`
+	Email        string `json:"email"`
+	Phone        string `json:"phone"`
+	PasswordHash string `json:"-"`
+	// EmailVerified is false until the applicant followed the link sent
+	// to Email, when email verification is on.
+	EmailVerified bool  `json:"emailVerified"`
+	CreatedAt     int64 `json:"createdAt"`
+	// ExpiresAt is the unix time the signup is purged, or 0 for never.
+	ExpiresAt int64 `json:"expiresAt,omitempty"`
+}
+
+// SignupStore keeps signups waiting for approval. A signup is deleted once
+// it has been approved or rejected.
+type SignupStore interface {
+	CreatePendingSignup(ps PendingSignup) error
+	// GetPendingSignup returns the signup with id, or an error if not found.
+	GetPendingSignup(id string) (*PendingSignup, error)
+	// ListPendingSignups returns all signups, oldest first.
+	ListPendingSignups() ([]PendingSignup, error)
+	// MarkPendingSignupVerified records that the email of a signup was
+	// confirmed and sets its new expiry.
+	MarkPendingSignupVerified(id string, expiresAt int64) error
+	DeletePendingSignup(id string) error
+}
+
+// SMSCodeStore keeps SMS password reset codes.
+type SMSCodeStore interface {
+	StoreSMSResetCode(id, username, code string, expiresAt int64) error
+	// VerifySMSResetCode checks code against the most recent unused code
+	// for username and consumes it on success. Every wrong guess counts
+	// against that code, which is burned after maxAttempts failures.
+	VerifySMSResetCode(username, code string, maxAttempts int) error
+}
+
+// Store is the full persistence interface used by the services.
+type Store interface {
+	UserMetaStore
+	SessionStore
+	TOTPEnrollmentStore
+	ResetTokenStore
+	SignupStore
+	SMSCodeStore
+
+	// PurgeExpired deletes every session, ticket, enrollment, token, code
+	// and signup that expired before now and returns the number of entries
+	// removed.
+	PurgeExpired(now int64) (int64, error)
+	// DeleteUserTokens removes every session, MFA ticket, TOTP enrollment,
+	// password reset token and SMS reset code issued to username, ignoring
+	// case, so none of them works for a user later given the same name.
+	DeleteUserTokens(username string) error
+	Close() error
+}
+
+// StateBackuper is implemented by stores that keep sessions, tickets,
+// tokens, signups and codes in a database file, so they can be part of a
+// backup. User metadata is backed up separately through ListUserMeta.
+type StateBackuper interface {
+	// BackupState writes a consistent copy of the database to path.
+	BackupState(path string) error
+	// RestoreState replaces the state tables with those of the database
+	// at path, after migrating it to the current schema.
+	RestoreState(path string) error
+}
+
+// Open creates the Store for backend. tomlPath is the users.toml file used
+// by the toml backend (and imported once by the sqlite backend); an empty
+// sqlitePath puts usermanagement.db next to it.
+func Open(backend, tomlPath, sqlitePath string) (Store, error) {
+	if sqlitePath == "" {
+		sqlitePath = filepath.Join(filepath.Dir(tomlPath), "usermanagement.db")
+	}
+	switch backend {
+	case "", BackendTOML:
+		return NewTOMLStore(tomlPath, sqlitePath)
+	case BackendSQLite:
+		return NewSQLiteStore(sqlitePath, tomlPath)
+	case BackendMemory:
+		return NewMemoryStore(), nil
+	default:
+		return nil, fmt.Errorf("unknown store backend %q", backend)
+	}
+}
+
+// StartJanitor purges expired entries from st every interval until the
+// returned stop function is called.
+func StartJanitor(st Store, interval time.Duration) (stop func()) {
+	if interval <= 0 {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			if n, err := st.PurgeExpired(time.Now().Unix()); err != nil {
+				log.Printf("[store] janitor: %v", err)
+			} else if n > 0 {
+				log.Printf("[store] janitor purged %d expired entries", n)
+			}
+			select {
+			case <-done:
+				return
+			case <-t.C:
+			}
+		}
+	}()
+	return func() { close(done) }
+}
+
+var (
+	_ Store = (*TOMLStore)(nil)
+	_ Store = (*SQLiteStore)(nil)
+	_ Store = (*MemoryStore)(nil)
+
+	_ StateBackuper = (*TOMLStore)(nil)
+	_ StateBackuper = (*SQLiteStore)(nil)
+)
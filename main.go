@@ -6,6 +6,8 @@ import (
 	"io/fs"
 	"log"
 	"net/http"
+	"os"
+	"time"
 
 	"tinyauth-usermanagement/internal/config"
 	"tinyauth-usermanagement/internal/handler"
@@ -23,24 +25,94 @@ var frontendFS embed.FS
 
 func main() {
 	cfg := config.Load()
+	if len(os.Args) > 1 {
+		os.Exit(runCommand(cfg, os.Args[1:]))
+	}
+	// Checked before anything is opened, so a refused start changes nothing.
+	if cfg.SessionSecret == config.DefaultSessionSecret {
+		log.Fatalf("SESSION_SECRET must be set: it signs signup and email change links and phone codes, which anyone could forge with the default")
+	}
 
-	st, err := store.NewStore("")
+	st, err := store.Open(cfg.StoreBackend, cfg.UsersTOMLPath, cfg.SQLitePath)
 	if err != nil {
 		log.Fatalf("failed to init store: %v", err)
 	}
 	defer st.Close()
+	stopJanitor := store.StartJanitor(st, time.Duration(cfg.StoreJanitorSeconds)*time.Second)
+	defer stopJanitor()
 
 	// Initialize providers
 	passwordTargets := provider.NewPasswordTargetProvider()
-	smsProvider := provider.NewWebhookSMSProvider()
+	smsProvider := provider.NewSMSProvider()
 
 	usersSvc := service.NewUserFileService(cfg)
+	if bad, err := usersSvc.CheckUsernames(service.NewUsernamePolicy(cfg)); err != nil {
+		log.Printf("[users] username check failed: %v", err)
+	} else {
+		for _, v := range bad {
+			log.Printf("[users] username %q breaks the username policy: %s", v.Username, v.Error)
+		}
+	}
+	usersSvc.OnExternalChange(func(changes []service.UserChange) {
+		for _, ch := range changes {
+			log.Printf("[users] user %s %s externally", ch.Username, ch.Kind)
+			if ch.Kind != service.UserRemoved {
+				continue
+			}
+			if _, ok, err := usersSvc.Find(ch.Username); err != nil || ok {
+				continue // re-created meanwhile, or unknown
+			}
+			// Like DeleteUser, so nobody later created under the name
+			// inherits the role, sessions or reset links of the user.
+			if err := st.DeleteUserMeta(ch.Username); err != nil {
+				log.Printf("[users] drop metadata of removed user %s: %v", ch.Username, err)
+			}
+			if err := st.DeleteUserTokens(ch.Username); err != nil {
+				log.Printf("[users] drop sessions of removed user %s: %v", ch.Username, err)
+			}
+		}
+	})
+	if cfg.UsersFileWatch {
+		stopWatcher, err := usersSvc.StartWatcher()
+		if err != nil {
+			log.Printf("[users] file watcher disabled: %v", err)
+		} else {
+			defer stopWatcher()
+		}
+	}
+	phonePolicy := service.NewPhonePolicy(cfg)
+	if err := phonePolicy.CheckRegion(); err != nil {
+		log.Fatalf("invalid PHONE_DEFAULT_REGION: %v", err)
+	}
+	if fixed, bad, err := service.NormalizeStoredPhones(st, phonePolicy); err != nil {
+		log.Printf("[users] phone number check failed: %v", err)
+	} else {
+		if fixed > 0 {
+			log.Printf("[users] rewrote %d phone number(s) in E.164 form", fixed)
+		}
+		for _, v := range bad {
+			log.Printf("[users] phone number %q of %s is ignored until fixed: %s", v.Phone, v.Username, v.Error)
+		}
+	}
 	mailSvc := service.NewMailService(cfg)
-	dockerSvc := service.NewDockerService(cfg)
+	reloader, err := service.NewReloader(cfg)
+	if err != nil {
+		log.Fatalf("failed to init reloader: %v", err)
+	}
+	reloadSvc := service.NewReloadService(cfg, reloader, service.NewHealthChecker(cfg), usersSvc)
+	reloadSvc.Start()
+	historySvc := service.NewHistoryService(cfg, st, usersSvc, reloadSvc)
+	historySvc.Start()
+	backupSvc := service.NewBackupService(cfg, st, usersSvc)
 	authSvc := service.NewAuthService(cfg, st, usersSvc)
-	accountSvc := service.NewAccountService(cfg, st, usersSvc, mailSvc, dockerSvc, passwordTargets, smsProvider)
+	accountSvc := service.NewAccountService(cfg, st, usersSvc, mailSvc, reloadSvc, passwordTargets, smsProvider)
+	limiter := service.NewRateLimitService(cfg)
+	adminSvc := service.NewAdminService(cfg, st, usersSvc, accountSvc, reloadSvc, passwordTargets)
 
 	r := gin.Default()
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatalf("invalid TRUSTED_PROXIES: %v", err)
+	}
 	r.Use(cors.New(cors.Config{
 		AllowOrigins:     cfg.CORSOrigins,
 		AllowMethods:     []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
@@ -50,16 +122,21 @@ func main() {
 
 	api := r.Group("/api")
 	{
-		authHandler := handler.NewAuthHandler(cfg, authSvc)
+		authHandler := handler.NewAuthHandler(cfg, authSvc, limiter)
 		authHandler.Register(api)
 
-		public := handler.NewPublicHandler(accountSvc)
+		public := handler.NewPublicHandler(accountSvc, limiter)
 		public.Register(api)
 
 		authed := api.Group("")
 		authed.Use(middleware.SessionMiddleware(cfg, st))
-		accountHandler := handler.NewAccountHandler(accountSvc)
+		accountHandler := handler.NewAccountHandler(accountSvc, limiter)
 		accountHandler.Register(authed)
+
+		admin := api.Group("/admin")
+		admin.Use(middleware.SessionMiddleware(cfg, st), middleware.AdminMiddleware(st, usersSvc))
+		adminHandler := handler.NewAdminHandler(adminSvc, historySvc, backupSvc, limiter)
+		adminHandler.Register(admin)
 	}
 
 	serveSPA(r)